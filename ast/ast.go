@@ -0,0 +1,112 @@
+/*
+Package ast is an optional, generic tree shape for peg grammars: a Handle
+callback can build a Node instead of returning a bare interface{}, giving
+callers something they can walk, rewrite or pretty-print generically
+instead of a nest of []interface{}.
+*/
+package ast
+
+import (
+    "fmt"
+    "strings"
+
+    "peg"
+)
+
+// Node is the interface a parse-tree node must satisfy to be walked by
+// Visit or rendered by PrettyPrint.
+//
+type Node interface {
+    Pos() peg.Position
+    End() peg.Position
+    Children() []Node
+}
+
+// Visit walks root's tree bottom-up -- children before their parent --
+// calling fn on every node reached, including root, and returns whatever fn
+// returns for root.  This mirrors the shape of the visit/rewrite pattern
+// used by HashiCorp's HIL AST, though since Children() hands back an
+// ordinary slice rather than mutable storage, fn can't replace a node's
+// children in place; callers that need a true rewrite should have fn build
+// a fresh node of their own type around the (already-visited) children.
+//
+func Visit(root Node, fn func(Node) Node) Node {
+    if root == nil {
+        return nil
+    }
+    for _, child := range root.Children() {
+        Visit(child, fn)
+    }
+    return fn(root)
+}
+
+// Literal is a leaf node wrapping a scalar value, e.g. a number or string
+// produced directly by a Handle callback.
+//
+type Literal struct {
+    Value         interface{}
+    Start, Finish peg.Position
+}
+
+func (n *Literal) Pos() peg.Position  { return n.Start }
+func (n *Literal) End() peg.Position  { return n.Finish }
+func (n *Literal) Children() []Node   { return nil }
+
+// BinaryOp is a two-operand operator application, e.g. the result of
+// parsing "a + b".
+//
+type BinaryOp struct {
+    Op            string
+    Left, Right   Node
+    Start, Finish peg.Position
+}
+
+func (n *BinaryOp) Pos() peg.Position { return n.Start }
+func (n *BinaryOp) End() peg.Position { return n.Finish }
+func (n *BinaryOp) Children() []Node  { return []Node{n.Left, n.Right} }
+
+// Call is a named function/rule application with an ordered argument list.
+//
+type Call struct {
+    Callee        string
+    Args          []Node
+    Start, Finish peg.Position
+}
+
+func (n *Call) Pos() peg.Position { return n.Start }
+func (n *Call) End() peg.Position { return n.Finish }
+func (n *Call) Children() []Node  { return n.Args }
+
+// PrettyPrint renders node and its descendants as an indented tree, mostly
+// useful for debugging a grammar's Handle callbacks.
+//
+func PrettyPrint(node Node) string {
+    var out strings.Builder
+    prettyPrint(&out, node, 0)
+    return out.String()
+}
+
+func prettyPrint(out *strings.Builder, node Node, depth int) {
+    if node == nil {
+        return
+    }
+    out.WriteString(strings.Repeat("  ", depth))
+    out.WriteString(describe(node))
+    out.WriteString("\n")
+    for _, child := range node.Children() {
+        prettyPrint(out, child, depth+1)
+    }
+}
+
+func describe(node Node) string {
+    switch n := node.(type) {
+    case *Literal:
+        return fmt.Sprintf("Literal(%v)", n.Value)
+    case *BinaryOp:
+        return fmt.Sprintf("BinaryOp(%s)", n.Op)
+    case *Call:
+        return fmt.Sprintf("Call(%s)", n.Callee)
+    default:
+        return fmt.Sprintf("%T", node)
+    }
+}
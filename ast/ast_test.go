@@ -0,0 +1,47 @@
+package ast
+
+import (
+    . "launchpad.net/gocheck"
+    "testing"
+
+    "peg"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+type MySuite struct{}
+var _ = Suite(&MySuite{})
+
+// A Handle callback can build a tree of ast.Node out of Info.Pos()/End(),
+// and Visit/PrettyPrint should walk and render it.
+//
+func (s *MySuite) TestVisitAndPrettyPrint(c *C) {
+
+    digit := peg.OneOrMoreOf(peg.AnyOf("0123456789")).Adjacent()
+    number := digit.Handle(func(info *peg.Info) interface{} {
+        return &Literal{Value: info.Text(), Start: info.Pos(), Finish: info.End()}
+    })
+
+    sum := peg.Sequence(number, peg.Literal("+"), number).
+        Handle(func(info *peg.Info) interface{} {
+            lhs := info.Get(1).Interface().(Node)
+            rhs := info.Get(3).Interface().(Node)
+            return &BinaryOp{Op: "+", Left: lhs, Right: rhs, Start: info.Pos(), Finish: info.End()}
+        })
+
+    result, err := sum.Parse("12+34")
+    c.Assert(err, IsNil)
+
+    node := result.(Node)
+    c.Check(node.Pos().Offset, Equals, 0)
+    c.Check(node.End().Offset, Equals, 5)
+
+    count := 0
+    Visit(node, func(n Node) Node {
+        count += 1
+        return n
+    })
+    c.Check(count, Equals, 3)
+
+    c.Check(PrettyPrint(node), Equals, "BinaryOp(+)\n  Literal(12)\n  Literal(34)\n")
+}
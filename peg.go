@@ -4,13 +4,22 @@ Package peg is a PEG-based parser.
 package peg
 
 import (
+    "fmt"
     "log"
     "reflect"
+    "sort"
     "strings"
+    "sync/atomic"
     "unicode"
 )
 
+// Assigns a stable, unique ID to each *Parser as it's constructed, for use as
+// a packrat cache key.
+var nextParserId int64
+
 type Parser struct {
+    // stable identity for this parser node, used as a packrat cache key
+    id int64
     // for debugging
     description string
     // non-nil if this is only a proxy for another parser
@@ -19,6 +28,12 @@ type Parser struct {
     allowEmpty bool
     // if true all subsidiary parsers don't skip whitespace
     adjacent bool
+    // if true, this parser's description is specific enough to surface in a
+    // farthest-failure diagnostic; leaves like Literal/AnyOf are reportable
+    // by default, compounds only once named via Describe()
+    reportable bool
+    // if true, results of invoke() are cached per input offset (see Memoize)
+    memoize bool
     // actual parse function, returns whether matched + amount of input consumed + user result
     parse func(state *state, input []rune) (bool, int, interface{})
     // if a compound parser, these are subsidiary parsers
@@ -33,6 +48,9 @@ type Parser struct {
     howFlat int
     // debug depth when Parse is called
     debug int
+    // non-nil if this parser was built by Range/Chars/Category/Union/
+    // Complement, so it can itself be combined by Union/Complement
+    matcher charMatcher
 }
 
 // This is passed to user callbacks.  Parser field is private because we don't want the user
@@ -44,6 +62,89 @@ type Info struct {
     matched []rune
     // user result returned from parser
     result interface{}
+    // state to resolve startOffset/endOffset against, on the rare handler
+    // that actually calls Info.Pos()/Info.End(); see positionAt
+    state *state
+    // where the match started and ended, as raw offsets -- resolving these
+    // to a line/column Position rescans the input from the start, so it's
+    // deferred to Pos()/End() instead of done for every handler invocation
+    startOffset int
+    endOffset   int
+}
+
+// A line/column/offset location within some parsed input, plus the name of
+// the file it came from, if any (see ParserConfig.Filename).
+//
+type Position struct {
+    Line     int
+    Column   int
+    Offset   int
+    Filename string
+}
+
+// Returned by Parse when the input doesn't match.  Message is a human-readable
+// summary; Position is the farthest point the parser reached before failing.
+//
+type ParseError struct {
+    Message  string
+    Position Position
+}
+
+func (err *ParseError) Error() string {
+    return err.Message
+}
+
+// Options for a single call to ParseWithConfig.  Filename only annotates
+// Position values in diagnostics.  ErrorHandler, if set, is called with the
+// ParseError before it's returned, so embedders (calculators, DSL front-ends,
+// ...) can log or display it without special-casing every call site.
+//
+type ParserConfig struct {
+    Filename     string
+    ErrorHandler func(*ParseError)
+    // if true, every parser is memoized, as if Memoize() had been called on it
+    Packrat bool
+}
+
+// Key identifying one packrat cache cell: a given parser, at a given absolute
+// input offset, under a given whitespace-skipping regime (since the same
+// parser at the same offset can behave differently depending on noSkip).
+//
+type cacheKey struct {
+    id        int64
+    offset    int
+    noSkip    int
+    predicate bool
+}
+
+// Cached outcome of a single parser.parse() call, as returned to invoke().
+//
+type cacheEntry struct {
+    match  bool
+    used   int
+    result interface{}
+}
+
+// Identifies one growing left-recursive rule application: a Deferred/Bind
+// rule's identity at an absolute input offset.  Unlike cacheKey this ignores
+// noSkip/predicate, since seed-growing tracks a rule's recursion, not its
+// memoized parse outcome.
+//
+type ruleKey struct {
+    id     int64
+    offset int
+}
+
+// Warth et al.'s seed-growing state for one rule application: the best match
+// found so far (the "seed"), whether this rule actually recursed back into
+// itself while computing it, and which memoized parsers' results (at the
+// same offset) were computed using this seed and must be invalidated before
+// each re-grow.
+//
+type growFrame struct {
+    seed     cacheEntry
+    recursed bool
+    involved map[int64]bool
 }
 
 type state struct {
@@ -53,27 +154,275 @@ type state struct {
     depth int
     // debug depth
     debug int
+    // the full input; slices seen by invoke() are always suffixes of this,
+    // so len(original) - len(input) gives an absolute offset
+    original []rune
+    // farthest offset at which a reportable parser has failed so far
+    farthestOffset int
+    // descriptions of the reportable parsers that failed at farthestOffset
+    farthestNames map[string]bool
+    // options for the current parse, may be nil
+    config *ParserConfig
+    // packrat cache, lazily allocated on first use
+    memo map[cacheKey]cacheEntry
+    // >0 while evaluating the subparser of an And/Not predicate: suppresses
+    // farthest-failure recording and handler invocation for that subparser
+    predicate int
+    // rule applications currently growing a left-recursive seed, keyed by
+    // rule identity + offset; see Parser.invokeRule
+    heads map[ruleKey]*growFrame
 }
 
-// Return a Parser that matches any character in a string.
+// Discard any memoized parse outcomes for the given rule IDs at offset, so
+// they get recomputed against a freshly grown left-recursive seed rather
+// than replayed from a stale cache entry.
+//
+func (state *state) invalidateMemo(ids map[int64]bool, offset int) {
+    for key := range state.memo {
+        if key.offset == offset && ids[key.id] {
+            delete(state.memo, key)
+        }
+    }
+}
+
+// Look up a packrat cache entry; a cache not yet allocated (see memoStore,
+// which allocates it lazily on first use) simply misses.
+//
+func (state *state) memoLookup(key cacheKey) (cacheEntry, bool) {
+    if state.memo == nil {
+        return cacheEntry{}, false
+    }
+    entry, ok := state.memo[key]
+    return entry, ok
+}
+
+func (state *state) memoStore(key cacheKey, entry cacheEntry) {
+    if state.memo == nil {
+        state.memo = make(map[cacheKey]cacheEntry)
+    }
+    state.memo[key] = entry
+}
+
+// Record that a reportable parser failed to match at offset, tracking the
+// farthest such offset seen and the set of parsers that were tried there.
+//
+func (state *state) recordFailure(offset int, name string) {
+    if offset > state.farthestOffset {
+        state.farthestOffset = offset
+        state.farthestNames = map[string]bool{name: true}
+    } else if offset == state.farthestOffset {
+        state.farthestNames[name] = true
+    }
+}
+
+// Compute the Position of an absolute rune offset into the original input.
+//
+func (state *state) positionAt(offset int) Position {
+    line, column := 1, 1
+    for _, char := range state.original[:offset] {
+        if char == '\n' {
+            line += 1
+            column = 1
+        } else {
+            column += 1
+        }
+    }
+    filename := ""
+    if state.config != nil {
+        filename = state.config.Filename
+    }
+    return Position{line, column, offset, filename}
+}
+
+// Synthesize a ParseError from the farthest failure recorded during a parse.
+//
+func (state *state) buildError() *ParseError {
+    position := state.positionAt(state.farthestOffset)
+    names := make([]string, 0, len(state.farthestNames))
+    for name := range state.farthestNames {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    var message string
+    switch len(names) {
+    case 0:
+        message = fmt.Sprintf("parse error at %d:%d", position.Line, position.Column)
+    case 1:
+        message = fmt.Sprintf("parse error at %d:%d: expected %s", position.Line, position.Column, names[0])
+    default:
+        message = fmt.Sprintf("parse error at %d:%d: expected one of [%s]", position.Line, position.Column, strings.Join(names, ", "))
+    }
+    return &ParseError{message, position}
+}
+
+// Return a Parser that matches any character in a string.  Built on Chars,
+// so lookup of an ASCII rune is an O(1) bitmap test rather than a linear
+// scan of str; runes at or above 128 are checked against a list of ranges.
 //
 func AnyOf(str string) *Parser {
-    return newParser("Anyof(" + str + ")", false, nil, func(state *state, input []rune) (bool, int, interface{}) {
-        // TODO: optimize
-        for _, char := range str {
-            if input[0] == char {
-                return true, 1, nil
-            }
+    return Chars(str).Describe("Anyof(" + str + ")")
+}
+
+// charMatcher is what backs a CharClass-style parser (Range, Chars,
+// Category, Union, Complement): something that can say whether a single
+// rune belongs.
+//
+type charMatcher interface {
+    matches(r rune) bool
+}
+
+// A set of individual runes and closed ranges.  ASCII membership (the
+// common case) is an O(1) test against a 128-bit bitmap; anything at or
+// above rune 128 falls back to a linear scan of the (usually short) list of
+// ranges that reach that far.
+//
+type bitmapClass struct {
+    ascii  [2]uint64
+    ranges []runeRange
+}
+
+type runeRange struct {
+    lo, hi rune
+}
+
+func (b *bitmapClass) addRange(lo, hi rune) {
+    for r := lo; r <= hi && r < 128; r += 1 {
+        b.ascii[r/64] |= 1 << uint(r%64)
+    }
+    if hi >= 128 {
+        start := lo
+        if start < 128 {
+            start = 128
+        }
+        b.ranges = append(b.ranges, runeRange{start, hi})
+    }
+}
+
+func (b *bitmapClass) matches(r rune) bool {
+    if r < 0 {
+        return false
+    }
+    if r < 128 {
+        return b.ascii[r/64]&(1<<uint(r%64)) != 0
+    }
+    for _, rr := range b.ranges {
+        if r >= rr.lo && r <= rr.hi {
+            return true
+        }
+    }
+    return false
+}
+
+// Wraps a unicode.RangeTable, e.g. unicode.Letter or unicode.Digit.
+//
+type categoryClass struct {
+    table *unicode.RangeTable
+}
+
+func (cat *categoryClass) matches(r rune) bool {
+    return unicode.Is(cat.table, r)
+}
+
+type unionClass struct {
+    members []charMatcher
+}
+
+func (u *unionClass) matches(r rune) bool {
+    for _, member := range u.members {
+        if member.matches(r) {
+            return true
+        }
+    }
+    return false
+}
+
+type complementClass struct {
+    inner charMatcher
+}
+
+func (comp *complementClass) matches(r rune) bool {
+    return !comp.inner.matches(r)
+}
+
+// Build a single-rune Parser backed by a charMatcher, stashing the matcher
+// on the Parser itself so Union/Complement can combine it further.
+//
+func newCharClass(description string, matcher charMatcher) *Parser {
+    parser := newParser(description, false, true, nil, func(state *state, input []rune) (bool, int, interface{}) {
+        if matcher.matches(input[0]) {
+            return true, 1, nil
         }
         return false, 0, nil
     })
+    parser.matcher = matcher
+    return parser
+}
+
+// Return a Parser matching any single rune in the closed range [lo, hi].
+//
+func Range(lo, hi rune) *Parser {
+    bitmap := &bitmapClass{}
+    bitmap.addRange(lo, hi)
+    return newCharClass(fmt.Sprintf("[%c-%c]", lo, hi), bitmap)
+}
+
+// Return a Parser matching any single rune in chars.  Like AnyOf, but
+// combinable with Union/Complement.
+//
+func Chars(chars string) *Parser {
+    bitmap := &bitmapClass{}
+    for _, r := range chars {
+        bitmap.addRange(r, r)
+    }
+    return newCharClass("["+chars+"]", bitmap)
+}
+
+// Return a Parser matching any rune in a unicode.RangeTable, e.g.
+// Category(unicode.Letter).
+//
+func Category(table *unicode.RangeTable) *Parser {
+    return newCharClass("category", &categoryClass{table})
 }
 
+// Return a Parser matching any rune matched by one or more of the given
+// Range/Chars/Category/Union/Complement parsers.  Panics if any argument
+// wasn't built by one of those.
+//
+func Union(parsers ...*Parser) *Parser {
+    members := make([]charMatcher, len(parsers))
+    for i, parser := range parsers {
+        if parser.matcher == nil {
+            panic("peg: Union argument is not a character class (Range/Chars/Category/Union/Complement)")
+        }
+        members[i] = parser.matcher
+    }
+    return newCharClass("union", &unionClass{members})
+}
+
+// Return a Parser matching any rune NOT matched by parser.  Panics if parser
+// wasn't built by Range/Chars/Category/Union/Complement.
+//
+func Complement(parser *Parser) *Parser {
+    if parser.matcher == nil {
+        panic("peg: Complement argument is not a character class (Range/Chars/Category/Union/Complement)")
+    }
+    return newCharClass("complement", &complementClass{parser.matcher})
+}
+
+// Convenience character classes for common categories.
+//
+var (
+    Letter       = Category(unicode.Letter)
+    Digit        = Category(unicode.Digit)
+    AlphaNumeric = Union(Letter, Digit)
+    Whitespace   = Category(unicode.White_Space)
+)
+
 // Return a Parser that will match what another parser later specified with Bind() matches.
 // TODO: helpful error message if user neglects to call Bind()
 //
 func Deferred() *Parser {
-    return newParser("Proxy", false, nil, nil)
+    return newParser("Proxy", false, false, nil, nil)
 }
 
 // Return a Parser that matches a literal string in the input; also establishes
@@ -82,7 +431,7 @@ func Deferred() *Parser {
 func Literal(str string) *Parser {
     runes := []rune(str)
     strLen := len(runes)
-    return newParser("Literal(" + str + ")", len(str) == 0, nil, func(state *state, input []rune) (bool, int, interface{}) {
+    return newParser("\""+str+"\"", len(str) == 0, true, nil, func(state *state, input []rune) (bool, int, interface{}) {
         inputLen := len(input)
         if strLen > inputLen {
             return false, 0, nil
@@ -100,7 +449,7 @@ func Literal(str string) *Parser {
 // and stops after the first that matches.
 //
 func OneOf(parsers ...*Parser) *Parser {
-    return newParser("OneOf", false, parsers, func(state *state, input[]rune) (bool, int, interface{}) {
+    return newParser("OneOf", false, false, parsers, func(state *state, input[]rune) (bool, int, interface{}) {
         for _, parser := range parsers {
             match, used, result := parser.invoke(state, input)
             if match {
@@ -115,7 +464,7 @@ func OneOf(parsers ...*Parser) *Parser {
 // in the supplied list of parsers matches.
 //
 func ZeroOrMoreOf(parsers ...*Parser) *Parser {
-    return newParser("ZeroOrMoreOf", true, parsers, func(state *state, input[]rune) (bool, int, interface{}) {
+    return newParser("ZeroOrMoreOf", true, false, parsers, func(state *state, input[]rune) (bool, int, interface{}) {
         return someOf(false, state, parsers, input)
     })
 }
@@ -123,7 +472,7 @@ func ZeroOrMoreOf(parsers ...*Parser) *Parser {
 // Like ZeroOrMoreOf but must match at least one, once.
 //
 func OneOrMoreOf(parsers ...*Parser) *Parser {
-    return newParser("OneOrMoreOf", false, parsers, func(state *state, input[]rune) (bool, int, interface{}) {
+    return newParser("OneOrMoreOf", false, false, parsers, func(state *state, input[]rune) (bool, int, interface{}) {
         return someOf(true, state, parsers, input)
     })
 }
@@ -154,7 +503,7 @@ func someOf(mustMatch bool, state *state, parsers []*Parser, input []rune) (bool
 //
 
 func Optional(parser *Parser) *Parser {
-    return newParser("OneOf", true, []*Parser{parser}, func(state *state, input[]rune) (bool, int, interface{}) {
+    return newParser("OneOf", true, false, []*Parser{parser}, func(state *state, input[]rune) (bool, int, interface{}) {
         match, used, result := parser.invoke(state, input)
         if match {
             return match, used, result
@@ -163,11 +512,41 @@ func Optional(parser *Parser) *Parser {
     })
 }
 
+// Return a Parser that succeeds iff parser matches at the current position,
+// but consumes no input and returns a nil result (the PEG "&" and-predicate).
+// Does not invoke parser's handler, and a failed match here is not recorded
+// as a farthest-failure candidate, since this is lookahead, not a real
+// attempt to consume input.
+//
+func And(parser *Parser) *Parser {
+    return newParser("&(" + parser.description + ")", true, false, []*Parser{parser}, func(state *state, input[]rune) (bool, int, interface{}) {
+        state.predicate += 1
+        match, _, _ := parser.invoke(state, input)
+        state.predicate -= 1
+        return match, 0, nil
+    })
+}
+
+// Return a Parser that succeeds iff parser does NOT match at the current
+// position, consuming no input and returning a nil result (the PEG "!"
+// not-predicate).  Does not invoke parser's handler, and parser failing to
+// match -- the expected, successful case for Not -- is not recorded as a
+// farthest-failure candidate.
+//
+func Not(parser *Parser) *Parser {
+    return newParser("!(" + parser.description + ")", true, false, []*Parser{parser}, func(state *state, input[]rune) (bool, int, interface{}) {
+        state.predicate += 1
+        match, _, _ := parser.invoke(state, input)
+        state.predicate -= 1
+        return !match, 0, nil
+    })
+}
+
 // Return a parser that matches if each of the supplied parsers
 // matches when tried in succession.
 //
 func Sequence(parsers ...*Parser) *Parser {
-    return newParser("Sequence", false, parsers, func(state *state, input []rune) (bool, int, interface{}) {
+    return newParser("Sequence", false, false, parsers, func(state *state, input []rune) (bool, int, interface{}) {
         totalUsed := 0
         results := make([]interface{}, 0)
         for _, parser := range parsers {
@@ -185,15 +564,46 @@ func Sequence(parsers ...*Parser) *Parser {
 
 // Creates a Parser node around a parsing function.
 //
-func newParser(info string, allowEmpty bool, subParsers []*Parser, 
+func newParser(info string, allowEmpty bool, reportable bool, subParsers []*Parser,
                parse func(state *state, input []rune) (bool, int, interface{})) *Parser {
-    return &Parser{info, nil, allowEmpty, false, parse, subParsers, nil, Info{}, false, 0, 0}
+    id := atomic.AddInt64(&nextParserId, 1)
+    return &Parser{id, info, nil, allowEmpty, false, reportable, false, parse, subParsers, nil, Info{}, false, 0, 0, nil}
 }
 
-// Run one pass of a parser.  Skips whitespace if directed, and invokes
-// the handler with the string matched.
+// Run one pass of a parser, consulting the packrat cache first if this
+// parser is memoized.  A cache hit replays the previously computed
+// (match, used, result) -- including whatever a Handle callback returned --
+// without re-running parser.parse or the handler, which is why handlers must
+// be side-effect-free under memoization: a rule "tried" many times at the
+// same offset by backtracking alternatives only really runs once.
 //
 func (parser *Parser) invoke(state *state, input []rune) (bool, int, interface{}) {
+    packrat := parser.memoize || (state.config != nil && state.config.Packrat)
+    if !packrat {
+        return parser.invokeUncached(state, input)
+    }
+    // Any memoized parser invoked while a left-recursive head is growing has
+    // to be recorded as involved in that head's answer, not just the head
+    // rule itself: a grown seed can change what every parser reachable from
+    // the head's body matches at this offset, not only the head's own cache
+    // cell, so invokeRule's invalidateMemo needs all of them to avoid
+    // replaying a stale answer computed against an earlier, shorter seed.
+    for _, head := range state.heads {
+        head.involved[parser.id] = true
+    }
+    key := cacheKey{parser.id, len(state.original) - len(input), state.noSkip, state.predicate > 0}
+    if entry, ok := state.memoLookup(key); ok {
+        return entry.match, entry.used, entry.result
+    }
+    match, used, result := parser.invokeUncached(state, input)
+    state.memoStore(key, cacheEntry{match, used, result})
+    return match, used, result
+}
+
+// Does the actual work of invoke(): skips whitespace if directed, and invokes
+// the handler with the string matched.
+//
+func (parser *Parser) invokeUncached(state *state, input []rune) (bool, int, interface{}) {
 
     indent := func() string { return strings.Repeat(" ", state.depth * 4) }
 
@@ -217,7 +627,7 @@ func (parser *Parser) invoke(state *state, input []rune) (bool, int, interface{}
     }()
 
     if (parser.delegate != nil) {
-        match, used, result = parser.delegate.invoke(state, input)
+        match, used, result = parser.invokeRule(state, input)
         return match, used, result
     }
 
@@ -227,7 +637,13 @@ func (parser *Parser) invoke(state *state, input []rune) (bool, int, interface{}
     if space > 0 {
         input = input[space:]
     }
-    if len(input) == 0 && !parser.allowEmpty {
+    // Only fast-reject here for leaf parsers (no subParsers); compounds must
+    // still dispatch into parser.parse so their failing leaf gets a chance to
+    // record itself for the farthest-failure diagnostic.
+    if len(input) == 0 && !parser.allowEmpty && parser.subParsers == nil {
+        if parser.reportable && state.predicate == 0 {
+            state.recordFailure(len(state.original)-len(input), parser.description)
+        }
         return false, 0, nil
     }
     if parser.adjacent {
@@ -236,6 +652,10 @@ func (parser *Parser) invoke(state *state, input []rune) (bool, int, interface{}
 
     match, used, result = parser.parse(state, input)
 
+    if !match && parser.reportable && state.predicate == 0 {
+        state.recordFailure(len(state.original)-len(input), parser.description)
+    }
+
     if match {
         if parser.flatten {
             if reflect.ValueOf(result).Kind() == reflect.Slice {
@@ -252,9 +672,13 @@ func (parser *Parser) invoke(state *state, input []rune) (bool, int, interface{}
                 }
             }
         }
-        if match && parser.handler != nil {
+        if match && parser.handler != nil && state.predicate == 0 {
+            startOffset := len(state.original) - len(input)
             parser.context.matched = input[:used]
             parser.context.result = result
+            parser.context.state = state
+            parser.context.startOffset = startOffset
+            parser.context.endOffset = startOffset + used
             if state.debug > 0 {
                 log.Printf("%sHandler => %#v\n", indent(), result)
             }
@@ -272,6 +696,55 @@ func (parser *Parser) invoke(state *state, input []rune) (bool, int, interface{}
     return match, used + space, result
 }
 
+// Run a Deferred/Bind rule using Warth et al.'s seed-growing packrat
+// algorithm, so direct and indirect left recursion (e.g. expr := expr op
+// term | term) terminates instead of looping forever.
+//
+// On entry, a FAIL sentinel is planted for (parser, offset) in state.heads.
+// If the rule's body recurses back into the same (parser, offset) while
+// being evaluated, that recursive call returns the current seed instead of
+// recursing again; if the body never does this, the rule isn't actually
+// left-recursive here and the single pass below is the final answer. If it
+// does, and the pass grows a longer match than the seed, the seed is
+// replaced and the body is re-run at the same offset to grow it further; any
+// memoized parser invoked while computing it (itself, or any other parser
+// reached while growing it, not just nested rules) has its answer at this
+// offset discarded first, so it's recomputed against the new seed rather
+// than replayed stale. This
+// repeats until a pass fails to grow the match, at which point the last
+// successful seed is the rule's result.
+//
+func (parser *Parser) invokeRule(state *state, input []rune) (bool, int, interface{}) {
+    offset := len(state.original) - len(input)
+    key := ruleKey{parser.id, offset}
+
+    if state.heads == nil {
+        state.heads = make(map[ruleKey]*growFrame)
+    }
+
+    if frame, growing := state.heads[key]; growing {
+        frame.recursed = true
+        return frame.seed.match, frame.seed.used, frame.seed.result
+    }
+
+    frame := &growFrame{seed: cacheEntry{false, 0, nil}, involved: map[int64]bool{parser.id: true}}
+    state.heads[key] = frame
+
+    match, used, result := parser.delegate.invoke(state, input)
+
+    if frame.recursed {
+        for match && used > frame.seed.used {
+            frame.seed = cacheEntry{match, used, result}
+            state.invalidateMemo(frame.involved, offset)
+            match, used, result = parser.delegate.invoke(state, input)
+        }
+        match, used, result = frame.seed.match, frame.seed.used, frame.seed.result
+    }
+
+    delete(state.heads, key)
+    return match, used, result
+}
+
 func (parser *Parser) skipWhite(state *state, input[] rune) int {
     space := 0
     if state.noSkip == 0 {
@@ -318,6 +791,21 @@ func (parser *Parser) Debug(depth int) *Parser {
     return parser
 }
 
+// Enable packrat memoization for this parser: repeated invocations at the
+// same input offset (and whitespace-skipping regime) are served from a cache
+// instead of re-running parser.parse, giving linear- rather than
+// exponential-time backtracking for grammars that try this parser repeatedly
+// at the same position (typical of OneOf/ZeroOrMoreOf).  ParserConfig.Packrat
+// enables this for every parser in a Parse call without tagging each one.
+// Because a cached result is only computed once, any side effects in this
+// parser's Handle callback will not run again on a cache hit -- handlers must
+// be side-effect-free when memoization is on.
+//
+func (parser *Parser) Memoize() *Parser {
+    parser.memoize = true
+    return parser
+}
+
 // Used with a Parser constructed with Deferred() -- specify the parser that will actually run.
 //
 func (parser *Parser) Bind(delegate *Parser) *Parser {
@@ -333,10 +821,13 @@ func (parser *Parser) Handle(handler func(info *Info) interface{}) *Parser {
     return parser
 }
 
-// Change the information string of the parser, used during debugging
+// Change the information string of the parser, used during debugging.  Also
+// marks the parser as reportable, so it can show up by name in a
+// farthest-failure diagnostic.
 //
 func (parser *Parser) Describe(text string) *Parser {
     parser.description = text
+    parser.reportable = true
     return parser
 }
 
@@ -358,10 +849,28 @@ func (parser *Parser) Flatten(depth int) *Parser {
     return parser
 }
 
-// Parse a string and return results.
+// Parse a string, returning the user result from a successful top-level match,
+// or a *ParseError describing the farthest point parsing reached otherwise.
+//
+func (parser *Parser) Parse(input string) (interface{}, *ParseError) {
+    return parser.ParseWithConfig(input, nil)
+}
+
+// Like Parse, but takes a ParserConfig so callers can supply a Filename for
+// diagnostics and/or an ErrorHandler to be notified of failures as they happen.
 //
-func (parser *Parser) Parse(input string) (bool, int, interface{}) {
-    return parser.invoke(&state{0, 0, parser.debug}, []rune(input))
+func (parser *Parser) ParseWithConfig(input string, config *ParserConfig) (interface{}, *ParseError) {
+    runes := []rune(input)
+    st := &state{debug: parser.debug, original: runes, farthestNames: make(map[string]bool), config: config}
+    match, _, result := parser.invoke(st, runes)
+    if match {
+        return result, nil
+    }
+    err := st.buildError()
+    if config != nil && config.ErrorHandler != nil {
+        config.ErrorHandler(err)
+    }
+    return nil, err
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -372,6 +881,19 @@ func (info *Info) Text() string {
     return string(info.matched)
 }
 
+// Return the position where the current Parser's match began, for handlers
+// that want to build AST nodes satisfying peg/ast.Node.
+//
+func (info *Info) Pos() Position {
+    return info.state.positionAt(info.startOffset)
+}
+
+// Return the position immediately after the current Parser's match ended.
+//
+func (info *Info) End() Position {
+    return info.state.positionAt(info.endOffset)
+}
+
 // Returns the length of the user data array, if an array; else
 // returns 0.
 //
@@ -396,3 +918,374 @@ func (info *Info) Get(index int) reflect.Value {
     return val.Index(index - 1).Elem()
 }
 
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Parses the small grammar language understood by LoadGrammar, building a
+// map of rule name -> *Parser as it goes.  Forward references to rules not
+// yet seen are resolved by handing out a Deferred() on first mention and
+// Bind()-ing it once the rule's own "name = ... ;" is reached, exactly as a
+// caller wiring up recursive combinators by hand would.
+//
+type grammarParser struct {
+    runes   []rune
+    pos     int
+    rules   map[string]*Parser
+    actions map[string]func(*Info) interface{}
+}
+
+// LoadGrammar parses a small EBNF-ish grammar language and returns the
+// *Parser for each rule it defines, keyed by rule name.  The language is:
+//
+//     greeting = "hello" name {makeGreeting} ;
+//     name     = [a-zA-Z]+ ;
+//
+//   - `name = expr ;` defines a rule; rules may be given in any order and
+//     may refer to each other, including recursively.
+//   - `|` is choice, juxtaposition is sequence, exactly as OneOf/Sequence.
+//   - `*`, `+`, `?` are ZeroOrMoreOf/OneOrMoreOf/Optional on the term to
+//     their left; `&` and `!` are And/Not on the term to their right.
+//   - `"..."` is a Literal; `[a-zA-Z_]` is a character class (individual
+//     characters and a-z-style ranges), matched like AnyOf.
+//   - `{actionName}` may trail a sequence, and binds actions[actionName] as
+//     its Handle callback.
+//   - `( expr )` groups, as in ordinary EBNF.
+//
+// actions supplies the callbacks referenced by {actionName}; it's an error
+// for the grammar to reference a name actions doesn't have, or to reference
+// a rule that's never defined.
+//
+func LoadGrammar(src string, actions map[string]func(*Info) interface{}) (map[string]*Parser, error) {
+    g := &grammarParser{runes: []rune(src), rules: make(map[string]*Parser), actions: actions}
+    if err := g.parseGrammar(); err != nil {
+        return nil, err
+    }
+    for name, rule := range g.rules {
+        if rule.delegate == nil {
+            return nil, fmt.Errorf("grammar error: rule %q is referenced but never defined", name)
+        }
+    }
+    return g.rules, nil
+}
+
+func (g *grammarParser) parseGrammar() error {
+    for {
+        g.skipSpace()
+        if g.pos >= len(g.runes) {
+            return nil
+        }
+        name := g.parseName()
+        if name == "" {
+            return g.errorf("expected a rule name")
+        }
+        g.skipSpace()
+        if g.peek() != '=' {
+            return g.errorf("expected '=' after rule name %q", name)
+        }
+        g.advance()
+        body, err := g.parseChoice()
+        if err != nil {
+            return err
+        }
+        g.skipSpace()
+        if g.peek() != ';' {
+            return g.errorf("expected ';' after rule %q", name)
+        }
+        g.advance()
+        rule := g.ruleRef(name)
+        if rule.delegate != nil {
+            return g.errorf("rule %q is already defined", name)
+        }
+        rule.Bind(body)
+    }
+}
+
+func (g *grammarParser) parseChoice() (*Parser, error) {
+    first, err := g.parseSequence()
+    if err != nil {
+        return nil, err
+    }
+    alts := []*Parser{first}
+    for {
+        g.skipSpace()
+        if g.peek() != '|' {
+            break
+        }
+        g.advance()
+        next, err := g.parseSequence()
+        if err != nil {
+            return nil, err
+        }
+        alts = append(alts, next)
+    }
+    if len(alts) == 1 {
+        return alts[0], nil
+    }
+    return OneOf(alts...), nil
+}
+
+func (g *grammarParser) parseSequence() (*Parser, error) {
+    var factors []*Parser
+    for {
+        g.skipSpace()
+        if g.atSequenceEnd() {
+            break
+        }
+        factor, err := g.parsePredicated()
+        if err != nil {
+            return nil, err
+        }
+        factors = append(factors, factor)
+    }
+    if len(factors) == 0 {
+        return nil, g.errorf("expected at least one term")
+    }
+    g.skipSpace()
+    action := ""
+    if g.peek() == '{' {
+        name, err := g.parseAction()
+        if err != nil {
+            return nil, err
+        }
+        action = name
+    }
+    // Only wrap single, action-less terms in a fresh Sequence when there's
+    // something to attach; otherwise hand back the term (often a shared
+    // rule reference) as-is, so we never mutate a parser another rule also
+    // refers to.
+    var result *Parser
+    if len(factors) == 1 && action == "" {
+        result = factors[0]
+    } else {
+        result = Sequence(factors...)
+    }
+    if action != "" {
+        handler, ok := g.actions[action]
+        if !ok {
+            return nil, g.errorf("action %q is not in the actions map", action)
+        }
+        result = result.Handle(handler)
+    }
+    return result, nil
+}
+
+func (g *grammarParser) atSequenceEnd() bool {
+    switch g.peek() {
+    case '|', ')', ';', '{', 0:
+        return true
+    }
+    return false
+}
+
+func (g *grammarParser) parsePredicated() (*Parser, error) {
+    g.skipSpace()
+    switch g.peek() {
+    case '&':
+        g.advance()
+        inner, err := g.parseRepeated()
+        if err != nil {
+            return nil, err
+        }
+        return And(inner), nil
+    case '!':
+        g.advance()
+        inner, err := g.parseRepeated()
+        if err != nil {
+            return nil, err
+        }
+        return Not(inner), nil
+    default:
+        return g.parseRepeated()
+    }
+}
+
+func (g *grammarParser) parseRepeated() (*Parser, error) {
+    primary, err := g.parsePrimary()
+    if err != nil {
+        return nil, err
+    }
+    // A bare character class or string literal is a token, not a
+    // whitespace-separated sequence element, so repeating one must not
+    // skip internal whitespace -- "[0-9]+" should match "12" as one number,
+    // not swallow "1 2" as though the space were insignificant.  Repeated
+    // rule references and parenthesized groups keep the normal
+    // whitespace-tolerant behavior, since those are usually themselves
+    // whitespace-separated sequence elements (e.g. "(a b)*").
+    atomic := primary.matcher != nil || strings.HasPrefix(primary.description, "\"")
+    switch g.peek() {
+    case '*':
+        g.advance()
+        rep := ZeroOrMoreOf(primary)
+        if atomic {
+            rep.Adjacent()
+        }
+        return rep, nil
+    case '+':
+        g.advance()
+        rep := OneOrMoreOf(primary)
+        if atomic {
+            rep.Adjacent()
+        }
+        return rep, nil
+    case '?':
+        g.advance()
+        return Optional(primary), nil
+    }
+    return primary, nil
+}
+
+func (g *grammarParser) parsePrimary() (*Parser, error) {
+    g.skipSpace()
+    switch {
+    case g.peek() == '"':
+        return g.parseLiteral()
+    case g.peek() == '[':
+        return g.parseCharClass()
+    case g.peek() == '(':
+        g.advance()
+        inner, err := g.parseChoice()
+        if err != nil {
+            return nil, err
+        }
+        g.skipSpace()
+        if g.peek() != ')' {
+            return nil, g.errorf("expected ')'")
+        }
+        g.advance()
+        return inner, nil
+    case isNameStart(g.peek()):
+        name := g.parseName()
+        return g.ruleRef(name), nil
+    default:
+        return nil, g.errorf("expected a literal, character class, rule name or '('")
+    }
+}
+
+func (g *grammarParser) parseLiteral() (*Parser, error) {
+    g.advance() // opening quote
+    var text strings.Builder
+    for {
+        if g.pos >= len(g.runes) {
+            return nil, g.errorf("unterminated string literal")
+        }
+        char := g.runes[g.pos]
+        if char == '"' {
+            g.advance()
+            break
+        }
+        if char == '\\' && g.pos+1 < len(g.runes) {
+            g.pos += 1
+            char = g.runes[g.pos]
+        }
+        text.WriteRune(char)
+        g.pos += 1
+    }
+    return Literal(text.String()), nil
+}
+
+func (g *grammarParser) parseCharClass() (*Parser, error) {
+    g.advance() // opening '['
+    var chars strings.Builder
+    for {
+        if g.pos >= len(g.runes) {
+            return nil, g.errorf("unterminated character class")
+        }
+        char := g.runes[g.pos]
+        if char == ']' {
+            g.advance()
+            break
+        }
+        if char == '\\' && g.pos+1 < len(g.runes) {
+            g.pos += 1
+            chars.WriteRune(g.runes[g.pos])
+            g.pos += 1
+            continue
+        }
+        if g.pos+2 < len(g.runes) && g.runes[g.pos+1] == '-' && g.runes[g.pos+2] != ']' {
+            lo, hi := char, g.runes[g.pos+2]
+            for c := lo; c <= hi; c++ {
+                chars.WriteRune(c)
+            }
+            g.pos += 3
+            continue
+        }
+        chars.WriteRune(char)
+        g.pos += 1
+    }
+    return AnyOf(chars.String()), nil
+}
+
+func (g *grammarParser) parseAction() (string, error) {
+    g.advance() // opening '{'
+    name := g.parseName()
+    if name == "" {
+        return "", g.errorf("expected an action name after '{'")
+    }
+    g.skipSpace()
+    if g.peek() != '}' {
+        return "", g.errorf("expected '}' after action name %q", name)
+    }
+    g.advance()
+    return name, nil
+}
+
+// Return the existing *Parser for a rule name, or a fresh Deferred() if
+// this is the first time the grammar has mentioned it.
+//
+func (g *grammarParser) ruleRef(name string) *Parser {
+    if rule, ok := g.rules[name]; ok {
+        return rule
+    }
+    rule := Deferred().Describe(name)
+    g.rules[name] = rule
+    return rule
+}
+
+func (g *grammarParser) parseName() string {
+    start := g.pos
+    if g.pos >= len(g.runes) || !isNameStart(g.runes[g.pos]) {
+        return ""
+    }
+    g.pos += 1
+    for g.pos < len(g.runes) && isNameChar(g.runes[g.pos]) {
+        g.pos += 1
+    }
+    return string(g.runes[start:g.pos])
+}
+
+func (g *grammarParser) skipSpace() {
+    for g.pos < len(g.runes) && unicode.IsSpace(g.runes[g.pos]) {
+        g.pos += 1
+    }
+}
+
+func (g *grammarParser) peek() rune {
+    if g.pos >= len(g.runes) {
+        return 0
+    }
+    return g.runes[g.pos]
+}
+
+func (g *grammarParser) advance() {
+    g.pos += 1
+}
+
+func (g *grammarParser) errorf(format string, args ...interface{}) error {
+    line, column := 1, 1
+    for _, char := range g.runes[:g.pos] {
+        if char == '\n' {
+            line += 1
+            column = 1
+        } else {
+            column += 1
+        }
+    }
+    return fmt.Errorf("grammar error at %d:%d: %s", line, column, fmt.Sprintf(format, args...))
+}
+
+func isNameStart(char rune) bool {
+    return char == '_' || unicode.IsLetter(char)
+}
+
+func isNameChar(char rune) bool {
+    return char == '_' || unicode.IsLetter(char) || unicode.IsDigit(char)
+}
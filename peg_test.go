@@ -1,14 +1,15 @@
 package peg
 
 import (
-    . "launchpad.net/gocheck"
+    gc "launchpad.net/gocheck"
+    "strconv"
     "testing"
 )
 
 // Hook up gocheck into the "go test" runner. 
-func Test(t *testing.T) { TestingT(t) }
+func Test(t *testing.T) { gc.TestingT(t) }
 type MySuite struct{} 
-var _ = Suite(&MySuite{})
+var _ = gc.Suite(&MySuite{})
 
 type TypeVar struct {
     arrow *string
@@ -16,7 +17,7 @@ type TypeVar struct {
     varName *string
 }
 
-func (s *MySuite) TestBasics(c *C) {
+func (s *MySuite) TestBasics(c *gc.C) {
 
     letter := AnyOf("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_")
     number := AnyOf("0123456789")
@@ -26,8 +27,8 @@ func (s *MySuite) TestBasics(c *C) {
             return info.Text()
         })
 
-    _, _, result := identifier.Parse("foo")
-    c.Check("foo", Equals, result)
+    result, _ := identifier.Parse("foo")
+    c.Check("foo", gc.Equals, result)
 
     typeVar := Sequence(identifier, identifier).
         Handle(func(info *Info) interface{} {
@@ -57,3 +58,260 @@ func (s *MySuite) TestBasics(c *C) {
     search := Sequence(typeVar, ZeroOrMoreOf(step))
     search.Parse("a b -> c d ->> e f")
 }
+
+// Parse failures should report the farthest position reached, and name the
+// reportable parsers (Literals, AnyOf, or anything given a Describe) that
+// were tried there.
+//
+func (s *MySuite) TestParseError(c *gc.C) {
+
+    digit := AnyOf("0123456789").Describe("digit")
+    number := OneOrMoreOf(digit).Adjacent()
+    sum := Sequence(number, Literal("+"), number).Describe("sum")
+
+    result, err := sum.Parse("12 + ")
+    c.Check(result, gc.IsNil)
+    c.Assert(err, gc.NotNil)
+    c.Check(err.Position.Line, gc.Equals, 1)
+    c.Check(err.Position.Column, gc.Equals, 6)
+    c.Check(err.Message, gc.Equals, "parse error at 1:6: expected digit")
+
+    multiline, err2 := sum.Parse("12\n+ x")
+    c.Check(multiline, gc.IsNil)
+    c.Assert(err2, gc.NotNil)
+    c.Check(err2.Position.Line, gc.Equals, 2)
+    c.Check(err2.Position.Column, gc.Equals, 3)
+}
+
+// A Memoize()-d parser tried more than once at the same offset (typical of
+// OneOf backtracking) should only actually run once.
+//
+func (s *MySuite) TestMemoize(c *gc.C) {
+
+    count := 0
+    a := Literal("a").Handle(func(info *Info) interface{} {
+        count += 1
+        return info.Text()
+    }).Memoize()
+
+    alt := OneOf(Sequence(a, Literal("b")), Sequence(a, Literal("c")))
+
+    result, err := alt.Parse("ac")
+    c.Assert(err, gc.IsNil)
+    c.Check(result, gc.NotNil)
+    c.Check(count, gc.Equals, 1)
+}
+
+// And/Not should disambiguate a keyword from an identifier that merely
+// starts with it, without consuming input or polluting diagnostics.
+//
+func (s *MySuite) TestAndNot(c *gc.C) {
+
+    letter := AnyOf("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_")
+    digit := AnyOf("0123456789")
+    idChar := OneOf(letter, digit)
+
+    ifKeyword := Sequence(Literal("if"), Not(idChar)).Adjacent().
+        Handle(func(info *Info) interface{} { return info.Get(1).String() })
+
+    result, err := ifKeyword.Parse("if (x)")
+    c.Assert(err, gc.IsNil)
+    c.Check(result, gc.Equals, "if")
+
+    _, err2 := ifKeyword.Parse("ify")
+    c.Assert(err2, gc.NotNil)
+
+    lookahead := Sequence(And(Literal("foo")), Literal("foo")).
+        Handle(func(info *Info) interface{} { return info.Get(2).String() })
+    result3, err3 := lookahead.Parse("foo")
+    c.Assert(err3, gc.IsNil)
+    c.Check(result3, gc.Equals, "foo")
+}
+
+// Left recursion can be written directly, as "expr := expr op term | term",
+// and should grow to consume the longest possible left-associative match.
+//
+func (s *MySuite) TestLeftRecursion(c *gc.C) {
+
+    digit := AnyOf("0123456789")
+    term := OneOrMoreOf(digit).Adjacent().
+        Handle(func(info *Info) interface{} {
+            val, _ := strconv.Atoi(info.Text())
+            return val
+        })
+
+    op := OneOf(Literal("+"), Literal("-"))
+    expr := Deferred()
+    exprOpTerm := Sequence(expr, op, term).
+        Handle(func(info *Info) interface{} {
+            lhs := info.Get(1).Interface().(int)
+            rhs := info.Get(3).Interface().(int)
+            if info.Get(2).String() == "+" {
+                return lhs + rhs
+            }
+            return lhs - rhs
+        })
+    expr.Bind(OneOf(exprOpTerm, term))
+
+    result, err := expr.Parse("1 + 2 - 3")
+    c.Assert(err, gc.IsNil)
+    c.Check(result, gc.Equals, 0)
+
+    result2, err2 := expr.Parse("10 + 20 + 30")
+    c.Assert(err2, gc.IsNil)
+    c.Check(result2, gc.Equals, 60)
+}
+
+// The same left-recursive grammar should grow to the same left-associative
+// result under ParserConfig{Packrat: true}, which memoizes every parser
+// (not just ones with Memoize() called explicitly) -- so invokeRule's
+// invalidateMemo has to discard every memoized parser's stale answer at the
+// offset being grown, not only the memoized answers of other Deferred rules.
+//
+func (s *MySuite) TestLeftRecursionUnderPackrat(c *gc.C) {
+
+    digit := AnyOf("0123456789")
+    term := OneOrMoreOf(digit).Adjacent().
+        Handle(func(info *Info) interface{} {
+            val, _ := strconv.Atoi(info.Text())
+            return val
+        })
+
+    op := OneOf(Literal("+"), Literal("-"))
+    expr := Deferred()
+    exprOpTerm := Sequence(expr, op, term).
+        Handle(func(info *Info) interface{} {
+            lhs := info.Get(1).Interface().(int)
+            rhs := info.Get(3).Interface().(int)
+            if info.Get(2).String() == "+" {
+                return lhs + rhs
+            }
+            return lhs - rhs
+        })
+    expr.Bind(OneOf(exprOpTerm, term))
+
+    config := &ParserConfig{Packrat: true}
+
+    result, err := expr.ParseWithConfig("1 + 2 - 3", config)
+    c.Assert(err, gc.IsNil)
+    c.Check(result, gc.Equals, 0)
+
+    result2, err2 := expr.ParseWithConfig("10 + 20 + 30", config)
+    c.Assert(err2, gc.IsNil)
+    c.Check(result2, gc.Equals, 60)
+}
+
+// LoadGrammar should build a working parser graph from EBNF-ish source,
+// wiring rule references and {action} callbacks, and report a plain error
+// for grammars that reference an undefined rule.
+//
+func (s *MySuite) TestLoadGrammar(c *gc.C) {
+
+    src := `
+        expr   = term (("+" | "-") term)* {sum} ;
+        term   = number ;
+        number = [0-9]+ {makeNumber} ;
+    `
+    actions := map[string]func(*Info) interface{}{
+        "makeNumber": func(info *Info) interface{} {
+            val, _ := strconv.Atoi(info.Text())
+            return val
+        },
+        "sum": func(info *Info) interface{} {
+            total := info.Get(1).Interface().(int)
+            rest := info.Get(2)
+            for i := 0; i < rest.Len(); i++ {
+                pair := rest.Index(i).Elem().Interface().([]interface{})
+                op := pair[0].(string)
+                rhs := pair[1].(int)
+                if op == "+" {
+                    total += rhs
+                } else {
+                    total -= rhs
+                }
+            }
+            return total
+        },
+    }
+
+    rules, err := LoadGrammar(src, actions)
+    c.Assert(err, gc.IsNil)
+
+    result, perr := rules["expr"].Parse("1 + 2 - 3")
+    c.Assert(perr, gc.IsNil)
+    c.Check(result, gc.Equals, 0)
+
+    _, err2 := LoadGrammar(`a = b ;`, nil)
+    c.Assert(err2, gc.NotNil)
+}
+
+// Repeating a bare character class or string literal ("[0-9]+") must not
+// skip internal whitespace -- it's a token, not a whitespace-separated
+// sequence element -- while repeating a parenthesized group still tolerates
+// the normal whitespace between its elements.
+//
+func (s *MySuite) TestLoadGrammarCharClassRepetitionIsAdjacent(c *gc.C) {
+
+    src := `
+        digits = [0-9]+ ;
+    `
+    rules, err := LoadGrammar(src, nil)
+    c.Assert(err, gc.IsNil)
+
+    runes := []rune("1 2")
+    st := &state{original: runes, farthestNames: make(map[string]bool)}
+    match, used, _ := rules["digits"].invoke(st, runes)
+    c.Check(match, gc.Equals, true)
+    c.Check(used, gc.Equals, 1)
+
+    result, perr := rules["digits"].Parse("12")
+    c.Assert(perr, gc.IsNil)
+    c.Check(result, gc.Equals, "12")
+}
+
+// Range/Chars/Category/Union/Complement should combine into working
+// matchers, and AnyOf should still behave as before now that it's built on
+// Chars under the hood.
+//
+func (s *MySuite) TestCharClass(c *gc.C) {
+
+    ident := OneOrMoreOf(Union(Letter, Digit, Chars("_"))).Adjacent().
+        Handle(func(info *Info) interface{} { return info.Text() })
+
+    result, err := ident.Parse("foo_123")
+    c.Assert(err, gc.IsNil)
+    c.Check(result, gc.Equals, "foo_123")
+
+    consonant := Complement(Union(Chars("aeiou"), Range('0', '9')))
+    _, err2 := consonant.Parse("a")
+    c.Assert(err2, gc.NotNil)
+    _, err3 := Sequence(consonant).Parse("b")
+    c.Assert(err3, gc.IsNil)
+
+    old := AnyOf("xyz")
+    result4, err4 := old.Parse("y")
+    c.Assert(err4, gc.IsNil)
+    c.Check(result4, gc.IsNil)
+
+    c.Check(func() { Union(Literal("x")) }, gc.Panics,
+        "peg: Union argument is not a character class (Range/Chars/Category/Union/Complement)")
+}
+
+// Info.Pos()/End() should report the line/column span a Handle callback's
+// match covered, so peg/ast node constructors can use them directly.
+//
+func (s *MySuite) TestInfoPositions(c *gc.C) {
+
+    var start, end Position
+    word := OneOrMoreOf(AnyOf("abcdefghijklmnopqrstuvwxyz")).Adjacent().
+        Handle(func(info *Info) interface{} {
+            start = info.Pos()
+            end = info.End()
+            return info.Text()
+        })
+
+    _, err := word.Parse("  cat")
+    c.Assert(err, gc.IsNil)
+    c.Check(start, gc.Equals, Position{1, 3, 2, ""})
+    c.Check(end, gc.Equals, Position{1, 6, 5, ""})
+}
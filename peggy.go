@@ -4,14 +4,26 @@ Package peg is a PEG-based parser.
 package peggy
 
 import (
+    "fmt"
+    "io"
     "log"
     "reflect"
+    "sort"
     "strconv"
     "strings"
+    "sync/atomic"
     "unicode"
 )
 
+// Assigns a stable, unique ID to a *Parser the first time it's memoized and
+// actually needs one as a packrat cache key; most parsers never call
+// Memoize(true) and so never pay for one.
+var nextParserId int64
+
 type Parser struct {
+    // stable identity for this parser node, used as a packrat cache key;
+    // zero until the first invoke() of a memoized parser assigns one
+    id int64
     // for debugging
     description string
     // non-nil if this is only a proxy for another parser
@@ -20,6 +32,12 @@ type Parser struct {
     allowEmpty bool
     // if true all subsidiary parsers don't skip whitespace
     adjacent bool
+    // if true, this parser's description is specific enough to surface in a
+    // furthest-failure diagnostic; leaves like Literal/AnyOf are reportable
+    // by default, compounds only once named via Describe()
+    reportable bool
+    // if true, results of invoke() are cached per input offset (see Memoize)
+    memoize bool
     // actual parse function, returns whether matched + amount of input consumed + user result
     parse func(state *State, input []rune) (bool, int, interface{})
     // if a compound parser, these are subsidiary parsers
@@ -32,12 +50,59 @@ type Parser struct {
     howFlat int
     // debug depth when Parse is called
     debug int
+    // ParseReader lookahead cap in runes, 0 meaning unbounded; see MaxBacktrack
+    maxBacktrack int
+}
+
+// Key identifying one packrat cache cell: a given parser, at a given
+// absolute input offset, under a given predicate state.  predicate has to
+// be part of the key because And/Not suppress the subparser's handler (see
+// state.predicate below) -- without it, a parser tried once as a predicate
+// and once for real at the same offset would share a cache cell, and
+// whichever ran second would replay the other's handler-suppressed result.
+//
+type memoKey struct {
+    id        int64
+    offset    int
+    predicate bool
+}
+
+// Cached outcome of a single parser.parse() call, as returned to invoke().
+//
+type memoEntry struct {
+    match  bool
+    used   int
+    result interface{}
+}
+
+// Returned by Parse when the input doesn't match.  Line/Column/Offset locate
+// the furthest point the parser reached before failing; Expected names the
+// reportable parsers (Literals, AnyOf, or anything given a Describe) that
+// were tried there, and Got is what was actually found at that position.
+//
+type ParseError struct {
+    Line     int
+    Column   int
+    Offset   int
+    Expected []string
+    Got      string
+}
+
+func (err *ParseError) Error() string {
+    switch len(err.Expected) {
+    case 0:
+        return fmt.Sprintf("parse error at %d:%d", err.Line, err.Column)
+    case 1:
+        return fmt.Sprintf("parse error at %d:%d: expected %s, got %q", err.Line, err.Column, err.Expected[0], err.Got)
+    default:
+        return fmt.Sprintf("parse error at %d:%d: expected one of [%s], got %q", err.Line, err.Column, strings.Join(err.Expected, ", "), err.Got)
+    }
 }
 
 // Return a Parser that matches any character in a string.
 //
 func AnyOf(str string) *Parser {
-    return newParser("Anyof(" + str + ")", false, nil, func(state *State, input []rune) (bool, int, interface{}) {
+    return newParser("Anyof(" + str + ")", false, true, nil, func(state *State, input []rune) (bool, int, interface{}) {
         // TODO: optimize
         for _, char := range str {
             if input[0] == char {
@@ -48,11 +113,155 @@ func AnyOf(str string) *Parser {
     })
 }
 
+// Return a Parser that matches a single rune against a regexp-style
+// character class, e.g. CharClass("[a-zA-Z0-9_]") or CharClass("[^\n]").
+// The spec is bracketed like a regexp class: a leading "^" negates it,
+// "lo-hi" denotes a range, "\n \t \\ \] \-" are the recognized escapes, and
+// "\p{Name}" matches a whole Unicode category (L, Nd, Zs, ...) as resolved
+// by unicode.Categories.  The spec is compiled once into a handful of
+// already-sorted unicode.RangeTables, so matching a rune is a binary search
+// per table rather than the linear scan AnyOf does over its source string.
+//
+func CharClass(spec string) *Parser {
+    class := compileCharClass(spec)
+    return newParser("CharClass("+spec+")", false, true, nil, func(state *State, input []rune) (bool, int, interface{}) {
+        if class.matches(input[0]) {
+            return true, 1, nil
+        }
+        return false, 0, nil
+    })
+}
+
+// The compiled form of a CharClass spec: one or more already-sorted
+// unicode.RangeTables (one built from the spec's own ranges/escapes, one
+// more per \p{...} category it references) plus whether the whole class is
+// negated.
+//
+type charClassSpec struct {
+    tables []*unicode.RangeTable
+    negate bool
+}
+
+func (class *charClassSpec) matches(r rune) bool {
+    for _, table := range class.tables {
+        if unicode.Is(table, r) {
+            return !class.negate
+        }
+    }
+    return class.negate
+}
+
+// A single element scanned out of a CharClass spec's bracketed body: either
+// a literal rune (possibly one end of a "lo-hi" range) or a \p{Name}
+// category reference.
+//
+type ccToken struct {
+    isCategory bool
+    r          rune
+    category   string
+}
+
+func compileCharClass(spec string) *charClassSpec {
+    runes := []rune(spec)
+    if len(runes) < 2 || runes[0] != '[' || runes[len(runes)-1] != ']' {
+        panic(fmt.Sprintf("peggy: CharClass spec must be bracketed like \"[...]\", got %q", spec))
+    }
+    body := runes[1 : len(runes)-1]
+    negate := false
+    if len(body) > 0 && body[0] == '^' {
+        negate = true
+        body = body[1:]
+    }
+    tokens := scanCharClassTokens(body)
+    var ranges []unicode.Range32
+    var tables []*unicode.RangeTable
+    i := 0
+    for i < len(tokens) {
+        tok := tokens[i]
+        if tok.isCategory {
+            table, ok := unicode.Categories[tok.category]
+            if !ok {
+                panic(fmt.Sprintf("peggy: CharClass: unknown Unicode category %q", tok.category))
+            }
+            tables = append(tables, table)
+            i += 1
+            continue
+        }
+        if i+2 < len(tokens) && !tokens[i+1].isCategory && tokens[i+1].r == '-' && !tokens[i+2].isCategory {
+            lo, hi := tok.r, tokens[i+2].r
+            if hi < lo {
+                panic(fmt.Sprintf("peggy: CharClass: invalid range %c-%c", lo, hi))
+            }
+            ranges = append(ranges, unicode.Range32{Lo: uint32(lo), Hi: uint32(hi), Stride: 1})
+            i += 3
+            continue
+        }
+        ranges = append(ranges, unicode.Range32{Lo: uint32(tok.r), Hi: uint32(tok.r), Stride: 1})
+        i += 1
+    }
+    if len(ranges) > 0 {
+        sort.Slice(ranges, func(i, j int) bool { return ranges[i].Lo < ranges[j].Lo })
+        tables = append([]*unicode.RangeTable{{R32: ranges}}, tables...)
+    }
+    if len(tables) == 0 {
+        panic(fmt.Sprintf("peggy: CharClass: empty character class %q", spec))
+    }
+    return &charClassSpec{tables, negate}
+}
+
+// Scan a CharClass spec's bracketed body (after stripping "[", "]" and any
+// leading "^") into literal runes, range endpoints and \p{...} categories.
+//
+func scanCharClassTokens(body []rune) []ccToken {
+    var tokens []ccToken
+    i := 0
+    for i < len(body) {
+        if body[i] != '\\' {
+            tokens = append(tokens, ccToken{r: body[i]})
+            i += 1
+            continue
+        }
+        i += 1
+        if i >= len(body) {
+            panic("peggy: CharClass: trailing backslash")
+        }
+        switch body[i] {
+        case 'n':
+            tokens = append(tokens, ccToken{r: '\n'})
+            i += 1
+        case 't':
+            tokens = append(tokens, ccToken{r: '\t'})
+            i += 1
+        case '\\', ']', '-':
+            tokens = append(tokens, ccToken{r: body[i]})
+            i += 1
+        case 'p':
+            i += 1
+            if i >= len(body) || body[i] != '{' {
+                panic("peggy: CharClass: expected '{' after \\p")
+            }
+            i += 1
+            start := i
+            for i < len(body) && body[i] != '}' {
+                i += 1
+            }
+            if i >= len(body) {
+                panic("peggy: CharClass: unterminated \\p{...}")
+            }
+            tokens = append(tokens, ccToken{isCategory: true, category: string(body[start:i])})
+            i += 1
+        default:
+            panic(fmt.Sprintf("peggy: CharClass: unknown escape \\%c", body[i]))
+        }
+    }
+    return tokens
+}
+
 // Return a Parser that will match what another parser later specified with Bind() matches.
 // TODO: helpful error message if user neglects to call Bind()
 //
 func Deferred() *Parser {
-    return newParser("Proxy", false, nil, nil)
+    return newParser("Proxy", false, false, nil, nil)
 }
 
 // Return a Parser that matches a literal string in the input; also establishes
@@ -61,7 +270,7 @@ func Deferred() *Parser {
 func Literal(str string) *Parser {
     runes := []rune(str)
     strLen := len(runes)
-    return newParser("Literal(" + str + ")", len(str) == 0, nil, func(state *State, input []rune) (bool, int, interface{}) {
+    return newParser("Literal(" + str + ")", len(str) == 0, true, nil, func(state *State, input []rune) (bool, int, interface{}) {
         inputLen := len(input)
         if strLen > inputLen {
             return false, 0, nil
@@ -81,7 +290,7 @@ func Literal(str string) *Parser {
 //
 func OneOf(pv ...interface{}) *Parser {
     parsers := asParsers(pv)
-    return newParser("OneOf", false, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
+    return newParser("OneOf", false, false, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
         for _, parser := range parsers {
             match, used, result := parser.invoke(state, input)
             if match {
@@ -98,7 +307,7 @@ func OneOf(pv ...interface{}) *Parser {
 //
 func ZeroOrMoreOf(pv ...interface{}) *Parser {
     parsers := asParsers(pv)
-    return newParser("ZeroOrMoreOf", true, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
+    return newParser("ZeroOrMoreOf", true, false, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
         return someOf(false, state, parsers, input)
     })
 }
@@ -107,7 +316,7 @@ func ZeroOrMoreOf(pv ...interface{}) *Parser {
 //
 func OneOrMoreOf(pv ...interface{}) *Parser {
     parsers := asParsers(pv)
-    return newParser("OneOrMoreOf", false, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
+    return newParser("OneOrMoreOf", false, false, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
         return someOf(true, state, parsers, input)
     })
 }
@@ -139,7 +348,7 @@ func someOf(mustMatch bool, state *State, parsers []*Parser, input []rune) (bool
 //
 func Optional(p interface{}) *Parser {
     parsers := asParsers([]interface{}{p})
-    return newParser("OneOf", true, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
+    return newParser("OneOf", true, false, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
         match, used, result := parsers[0].invoke(state, input)
         if match {
             return match, used, result
@@ -148,12 +357,44 @@ func Optional(p interface{}) *Parser {
     })
 }
 
+// Return a Parser that succeeds iff p matches at the current position, but
+// consumes no input and returns a nil result (the PEG "&" and-predicate).
+// p is run through invoke so whitespace/adjacent semantics stay consistent,
+// but its handler is not invoked, since this is lookahead, not a real
+// attempt to consume input.  Argument may be *Parser or a string; the
+// latter is converted with Literal().
+//
+func And(p interface{}) *Parser {
+    parsers := asParsers([]interface{}{p})
+    return newParser("&(" + parsers[0].description + ")", true, false, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
+        state.predicate += 1
+        match, _, _ := parsers[0].invoke(state, input)
+        state.predicate -= 1
+        return match, 0, nil
+    })
+}
+
+// Return a Parser that succeeds iff p does NOT match at the current
+// position, consuming no input and returning a nil result (the PEG "!"
+// not-predicate).  Like And, p's handler is not invoked.  Argument may be
+// *Parser or a string; the latter is converted with Literal().
+//
+func Not(p interface{}) *Parser {
+    parsers := asParsers([]interface{}{p})
+    return newParser("!(" + parsers[0].description + ")", true, false, parsers, func(state *State, input[]rune) (bool, int, interface{}) {
+        state.predicate += 1
+        match, _, _ := parsers[0].invoke(state, input)
+        state.predicate -= 1
+        return !match, 0, nil
+    })
+}
+
 // Return a parser that matches if each of the supplied parsers
 // matches when tried in succession.
 //
 func Sequence(pv ...interface{}) *Parser {
     parsers := asParsers(pv)
-    return newParser("Sequence", false, parsers, func(state *State, input []rune) (bool, int, interface{}) {
+    return newParser("Sequence", false, false, parsers, func(state *State, input []rune) (bool, int, interface{}) {
         totalUsed := 0
         results := make([]interface{}, 0)
         for _, parser := range parsers {
@@ -171,9 +412,9 @@ func Sequence(pv ...interface{}) *Parser {
 
 // Creates a Parser node around a parsing function.
 //
-func newParser(info string, allowEmpty bool, subParsers []*Parser,
+func newParser(info string, allowEmpty bool, reportable bool, subParsers []*Parser,
                parse func(state *State, input []rune) (bool, int, interface{})) *Parser {
-   return &Parser{info, nil, allowEmpty, false, parse, subParsers, nil, false, 0, 0}
+   return &Parser{0, info, nil, allowEmpty, false, reportable, false, parse, subParsers, nil, false, 0, 0, 0}
 }
 
 // Converts untyped array of *Parser / string into []*Parser
@@ -196,30 +437,44 @@ func asParsers(pv []interface{}) []*Parser {
     return parsers
 } 
 
-// Run one pass of a parser.  Skips whitespace if directed, and invokes
-// the handler with the string matched.
+// Run one pass of a parser, consulting the packrat cache first if this
+// parser is memoized.  A cache hit replays the previously computed
+// (match, used, result) -- including whatever a Handle callback returned --
+// without re-running parser.parse or the handler, which is why handlers
+// must be side-effect-free under memoization: a rule tried many times at
+// the same offset by backtracking alternatives only really runs once.
 //
 func (parser *Parser) invoke(state *State, input []rune) (bool, int, interface{}) {
-
-    indent := func() string { return strings.Repeat(" ", state.depth * 4) }
-
-    if state.debug > 0 {
-        log.Printf("%s-> %s on '%s'\n", indent(), parser.description, string(input))
+    if !parser.memoize {
+        return parser.invokeUncached(state, input)
+    }
+    if parser.id == 0 {
+        parser.id = atomic.AddInt64(&nextParserId, 1)
     }
+    key := memoKey{parser.id, len(state.original) - len(input), state.predicate > 0}
+    if entry, ok := state.memoLookup(key); ok {
+        traceMemoHit(parser)
+        return entry.match, entry.used, entry.result
+    }
+    traceMemoMiss(parser)
+    match, used, result := parser.invokeUncached(state, input)
+    state.memoStore(key, memoEntry{match, used, result})
+    return match, used, result
+}
 
-    state.depth += 1
-    state.debug -= 1
+// Does the actual work of invoke(): skips whitespace if directed, and
+// invokes the handler with the string matched.
+//
+func (parser *Parser) invokeUncached(state *State, input []rune) (bool, int, interface{}) {
+
+    traceEnter(state, parser, input)
 
     var match bool
     var used int
     var result interface{}
 
     defer func() {
-        state.depth -= 1
-        state.debug += 1
-        if state.debug > 0 {
-            log.Printf("%s<- %s %v, len=%d, result=%v", indent(), parser.description, match, used, result)
-        }
+        traceExit(state, parser, match, used, result)
     }()
 
     if (parser.delegate != nil) {
@@ -233,7 +488,13 @@ func (parser *Parser) invoke(state *State, input []rune) (bool, int, interface{}
     if space > 0 {
         input = input[space:]
     }
-    if len(input) == 0 && !parser.allowEmpty {
+    // Only fast-reject here for leaf parsers (no subParsers); compounds must
+    // still dispatch into parser.parse so their failing leaf gets a chance to
+    // record itself for the furthest-failure diagnostic.
+    if len(input) == 0 && !parser.allowEmpty && parser.subParsers == nil {
+        if parser.reportable && state.predicate == 0 {
+            state.recordFailure(len(state.original)-len(input), parser.description)
+        }
         return false, 0, nil
     }
     if parser.adjacent {
@@ -242,32 +503,27 @@ func (parser *Parser) invoke(state *State, input []rune) (bool, int, interface{}
 
     match, used, result = parser.parse(state, input)
 
+    if !match && parser.reportable && state.predicate == 0 {
+        state.recordFailure(len(state.original)-len(input), parser.description)
+    }
+
     if match {
         if parser.flatten {
             if reflect.ValueOf(result).Kind() == reflect.Slice {
-                if state.debug > 0 {
-                    log.Printf("%sflatten -> %#v\n", indent(), result)
-                }
+                traceFlattenBefore(state, result)
                 result = flatten(make([]interface{}, 0), result, parser.howFlat + 1)
-                if state.debug > 0 {
-                    log.Printf("%sflatten <- %#v\n", indent(), result)
-                }
+                traceFlattenAfter(state, result)
             } else {
-                if state.debug > 0 {
-                    log.Printf("%scan't flatten %#v\n", indent(), result)
-                }
+                traceCantFlatten(state, result)
             }
         }
-        if match && parser.handler != nil {
+        if match && parser.handler != nil && state.predicate == 0 {
+            state.matchOffset = len(state.original) - len(input)
             state.matched = input[:used]
             state.result = result
-            if state.debug > 0 {
-                log.Printf("%sHandler => %#v\n", indent(), result)
-            }
+            traceHandlerBefore(state, result)
             result = parser.handler(state)
-            if state.debug > 0 {
-                log.Printf("%sHandler <= %#v\n", indent(), result)
-            }
+            traceHandlerAfter(state, result)
         }
     }
 
@@ -317,13 +573,45 @@ func (parser *Parser) Adjacent() *Parser {
 }
 
 // Set the debug level; n levels deep of parsers will log details of their execution.  Note this
-// applies only to the parser on which Parse() is called.
+// applies only to the parser on which Parse() is called.  Tracing itself only
+// compiles in under "-tags peggydebug" (see peggy_debug.go/peggy_nodebug.go);
+// without that tag this just records depth on the Parser for no observable
+// effect, so production builds don't pay for logging they never enabled.
 //
 func (parser *Parser) Debug(depth int) *Parser {
     parser.debug = depth
     return parser
 }
 
+// Enable (or disable) packrat memoization for this parser: repeated
+// invocations at the same input offset are served from a cache instead of
+// re-running parser.parse, giving linear- rather than exponential-time
+// backtracking for grammars that try this parser repeatedly at the same
+// position (typical of OneOf/ZeroOrMoreOf, or a Deferred rule reached from
+// more than one alternative).  Because a cached result is only computed
+// once, any side effects in this parser's Handle callback will not run
+// again on a cache hit -- handlers must be side-effect-free when
+// memoization is on.
+//
+func (parser *Parser) Memoize(enable bool) *Parser {
+    parser.memoize = enable
+    return parser
+}
+
+// Cap how many runes of lookahead ParseReader will buffer from its
+// io.RuneReader before giving up, instead of growing the buffer to fit the
+// whole stream.  Like Debug, this only takes effect on the parser
+// ParseReader is called on.  n == 0 (the default) means unbounded, which is
+// the right choice for Parse/ParseRaw-sized input; a stream parser that
+// expects its grammar to commit within a bounded window (e.g. one record
+// per line) should set this so a malformed stream fails fast with a clear
+// error rather than buffering forever waiting for a match that never comes.
+//
+func (parser *Parser) MaxBacktrack(n int) *Parser {
+    parser.maxBacktrack = n
+    return parser
+}
+
 // Used with a Parser constructed with Deferred() -- specify the parser that will actually run.
 //
 func (parser *Parser) Bind(delegate *Parser) *Parser {
@@ -348,10 +636,13 @@ func (parser *Parser) As(c Converter) *Parser {
     })
 }
 
-// Change the information string of the parser, used during debugging
+// Change the information string of the parser, used during debugging.  Also
+// marks the parser as reportable, so it can show up by name in a
+// furthest-failure diagnostic.
 //
 func (parser *Parser) Describe(text string) *Parser {
     parser.description = text
+    parser.reportable = true
     return parser
 }
 
@@ -386,10 +677,92 @@ func (parser *Parser) Flatten(depth int) *Parser {
     return parser
 }
 
-// Parse a string and return results.
+// Parse a string, returning the user result from a successful top-level
+// match, or a *ParseError describing the furthest point parsing reached
+// otherwise.
+//
+func (parser *Parser) Parse(input string) (interface{}, error) {
+    runes := []rune(input)
+    state := &State{0, 0, parser.debug, nil, nil, runes, nil, 0, 0, make(map[string]bool), 0, nil}
+    match, _, result := parser.invoke(state, runes)
+    tracePrintCounters()
+    if match {
+        return result, nil
+    }
+    return nil, state.buildError()
+}
+
+// Parse a string and return the raw (matched, consumed, result) tuple,
+// without building a *ParseError on failure.  Kept for callers still using
+// the pre-error-handling calling convention.
+//
+func (parser *Parser) ParseRaw(input string) (bool, int, interface{}) {
+    runes := []rune(input)
+    match, used, result := parser.invoke(&State{0, 0, parser.debug, nil, nil, runes, nil, 0, 0, make(map[string]bool), 0, nil}, runes)
+    tracePrintCounters()
+    return match, used, result
+}
+
+// How many more runes to pull from the reader each time ParseReader's
+// buffer turns out not to be enough yet.
+const parseReaderReadAhead = 256
+
+// Parse runes pulled from r, for callers with a log file or network stream
+// rather than an in-memory string.  Returns the same (matched, consumed,
+// result) tuple as ParseRaw, plus a non-nil error if r itself failed (io.EOF
+// is not an error here; it just ends the input) or the parse needed more
+// than MaxBacktrack runes of lookahead.
+//
+// Every built-in combinator's parse closure takes input as a []rune slice
+// and advances through it by reslicing ("input = input[used:]"), which
+// requires one contiguous backing array spanning from the start of the
+// current top-level match attempt -- so unlike a true incremental parser,
+// ParseReader can't release input before the match's own start without
+// corrupting it, and doing that for a subsequent match in the same stream
+// would need every parse closure converted to a (*State, offset) view, which
+// is a much bigger rewrite than this entry point justifies on its own.  What
+// ParseReader does instead: read just enough of r to attempt a match, and
+// only read more (in parseReaderReadAhead-rune increments) and retry the
+// whole attempt if that wasn't enough -- so a match found near the start of
+// a large stream never materializes the rest of it, and MaxBacktrack caps
+// how far that retry loop is allowed to grow the buffer before giving up,
+// bounding peak memory instead of buffering an unbounded non-matching
+// stream.
 //
-func (parser *Parser) Parse(input string) (bool, int, interface{}) {
-    return parser.invoke(&State{0, 0, parser.debug, nil, nil}, []rune(input))
+func (parser *Parser) ParseReader(r io.RuneReader) (bool, int, interface{}, error) {
+    var buf []rune
+    eof := false
+    for {
+        want := len(buf) + parseReaderReadAhead
+        if parser.maxBacktrack > 0 && want > parser.maxBacktrack {
+            want = parser.maxBacktrack
+        }
+        for !eof && len(buf) < want {
+            ch, _, err := r.ReadRune()
+            if err == io.EOF {
+                eof = true
+                break
+            }
+            if err != nil {
+                return false, 0, nil, err
+            }
+            buf = append(buf, ch)
+        }
+
+        state := &State{0, 0, parser.debug, nil, nil, buf, nil, 0, 0, make(map[string]bool), 0, nil}
+        matched, used, result := parser.invoke(state, buf)
+        tracePrintCounters()
+
+        if matched {
+            return matched, used, result, nil
+        }
+        if eof {
+            return matched, used, result, state.buildError()
+        }
+        if parser.maxBacktrack > 0 && len(buf) >= parser.maxBacktrack {
+            return false, 0, nil, fmt.Errorf("%s: no match within MaxBacktrack(%d) runes of lookahead", parser.description, parser.maxBacktrack)
+        }
+    }
 }
 
 ////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -408,6 +781,94 @@ type State struct {
     matched []rune
     // user result returned from parser
     result interface{}
+    // the full input; slices seen by invoke() are always suffixes of this,
+    // so len(original) - len(input) gives an absolute offset for the
+    // packrat cache
+    original []rune
+    // packrat cache, lazily allocated on first use
+    memo map[memoKey]memoEntry
+    // >0 while evaluating the subparser of an And/Not predicate: suppresses
+    // handler invocation for that subparser, since a predicate is lookahead
+    // rather than a real attempt to consume input
+    predicate int
+    // furthest offset at which a reportable parser has failed so far
+    farthestOffset int
+    // descriptions of the reportable parsers that failed at farthestOffset
+    farthestNames map[string]bool
+    // absolute offset where the current handler's match began, for State.Pos()
+    matchOffset int
+    // one frame per in-progress Compile()-d rule application, holding that
+    // rule's labeled captures ("label:expr") by name; see State.GetLabel
+    labelStack []map[string]interface{}
+}
+
+// Record that a reportable parser failed to match at offset, tracking the
+// furthest such offset seen and the set of parsers that were tried there.
+//
+func (state *State) recordFailure(offset int, name string) {
+    if offset > state.farthestOffset {
+        state.farthestOffset = offset
+        state.farthestNames = map[string]bool{name: true}
+    } else if offset == state.farthestOffset {
+        state.farthestNames[name] = true
+    }
+}
+
+// Compute the 1-based line/column of an absolute rune offset into the
+// original input.
+//
+func (state *State) positionAt(offset int) (int, int) {
+    line, column := 1, 1
+    for _, char := range state.original[:offset] {
+        if char == '\n' {
+            line += 1
+            column = 1
+        } else {
+            column += 1
+        }
+    }
+    return line, column
+}
+
+// Synthesize a ParseError from the furthest failure recorded during a parse.
+//
+func (state *State) buildError() *ParseError {
+    line, column := state.positionAt(state.farthestOffset)
+    names := make([]string, 0, len(state.farthestNames))
+    for name := range state.farthestNames {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    got := "<EOF>"
+    if state.farthestOffset < len(state.original) {
+        got = string(state.original[state.farthestOffset])
+    }
+    return &ParseError{line, column, state.farthestOffset, names, got}
+}
+
+// Return the line/column where the current Parser's match began, for
+// handlers that want to annotate AST nodes with source locations.
+//
+func (state *State) Pos() (int, int) {
+    return state.positionAt(state.matchOffset)
+}
+
+// Look up a packrat cache entry; a cache not yet allocated (see memoStore,
+// which allocates it lazily on first use) simply misses.
+//
+func (state *State) memoLookup(key memoKey) (memoEntry, bool) {
+    if state.memo == nil {
+        return memoEntry{}, false
+    }
+    entry, ok := state.memo[key]
+    return entry, ok
+}
+
+func (state *State) memoStore(key memoKey, entry memoEntry) {
+    if state.memo == nil {
+        state.memo = make(map[memoKey]memoEntry)
+    }
+    state.memo[key] = entry
 }
 
 // Return the text that was matched by the current Parser.
@@ -440,6 +901,30 @@ func (s *State) Get(index int) reflect.Value {
     return val.Index(index - 1).Elem()
 }
 
+// Return the value captured by a "label:expr" term of the Compile()-d rule
+// currently being matched, or nil if there's no such label in scope.
+//
+func (s *State) GetLabel(name string) interface{} {
+    if len(s.labelStack) == 0 {
+        return nil
+    }
+    return s.labelStack[len(s.labelStack)-1][name]
+}
+
+func (s *State) pushLabelFrame() {
+    s.labelStack = append(s.labelStack, make(map[string]interface{}))
+}
+
+func (s *State) popLabelFrame() {
+    s.labelStack = s.labelStack[:len(s.labelStack)-1]
+}
+
+func (s *State) setLabel(name string, value interface{}) {
+    if len(s.labelStack) > 0 {
+        s.labelStack[len(s.labelStack)-1][name] = value
+    }
+}
+
 ////////////////////////////////////////////////////////////////////////////////////////////////////
 
 // Objects implementing this interface may be passed to Parser.As for automatic conversion
@@ -493,3 +978,269 @@ const String = StringConverter(3)
 //
 const Strings = StringConverter(4)
 
+////////////////////////////////////////////////////////////////////////////////////////////////////
+
+// Compile builds a map of named *Parser values from a single grammar
+// string, the way pigeon or PEG.js do: one or more rules of the form
+//
+//     Name <- expr
+//
+// where expr may be a string literal ("..."), a character class ([...],
+// see CharClass), a reference to another rule by name, a parenthesized
+// group, an ordered choice (expr / expr), a whitespace-separated sequence,
+// the postfix repetition operators * + ?, the prefix lookahead predicates
+// & and !, or a labeled capture (label:expr) whose match becomes visible to
+// a Handle callback via State.GetLabel("label").  Actions are attached
+// afterwards with SetAction, since a rule's *Parser has to exist before a
+// callback referring to it (for recursive rules) can be written.
+//
+// The grammar parser below is itself built from Sequence/OneOf/ZeroOrMoreOf
+// and friends rather than hand-written scanning logic -- a self-hosting
+// proof that also exercises Deferred/Bind to resolve recursive rule
+// references, including "(" expr ")" recursing back into the grammar's own
+// top rule.
+//
+func Compile(grammar string) (rules map[string]*Parser, err error) {
+    defer func() {
+        if r := recover(); r != nil {
+            rules, err = nil, fmt.Errorf("peggy: grammar error: %v", r)
+        }
+    }()
+
+    // Deferred placeholders for rule references, created the first time a
+    // name is seen and reused for every later reference to that name, then
+    // Bound to the real rule once the whole grammar has been parsed.
+    refs := make(map[string]*Parser)
+    ruleRef := func(name string) *Parser {
+        if p, ok := refs[name]; ok {
+            return p
+        }
+        p := Deferred().Describe(name)
+        refs[name] = p
+        return p
+    }
+
+    expr := Deferred()
+
+    identTok := Sequence(CharClass("[A-Za-z_]"), ZeroOrMoreOf(CharClass("[A-Za-z0-9_]"))).
+        Adjacent().As(String).Describe("identifier")
+
+    primary := OneOf(
+        scanStringLiteral().Handle(func(s *State) interface{} { return Literal(s.result.(string)) }),
+        scanCharClassSpan().Handle(func(s *State) interface{} { return CharClass(s.result.(string)) }),
+        Sequence(Literal("("), expr, Literal(")")).Pick(2),
+        Sequence(identTok).Handle(func(s *State) interface{} {
+            return ruleRef(s.result.([]interface{})[0].(string))
+        }),
+    ).Describe("primary")
+
+    labeled := OneOf(
+        Sequence(identTok, Literal(":"), primary).Handle(func(s *State) interface{} {
+            parts := s.result.([]interface{})
+            name := parts[0].(string)
+            inner := parts[2].(*Parser)
+            return newParser(name+":"+inner.description, false, false, []*Parser{inner},
+                func(state *State, input []rune) (bool, int, interface{}) {
+                    match, used, result := inner.invoke(state, input)
+                    if match {
+                        state.setLabel(name, result)
+                    }
+                    return match, used, result
+                })
+        }),
+        primary,
+    ).Describe("labeled-term")
+
+    repeated := Sequence(labeled, Optional(CharClass("[*+?]").As(String))).Handle(func(s *State) interface{} {
+        parts := s.result.([]interface{})
+        p := parts[0].(*Parser)
+        if parts[1] == nil {
+            return p
+        }
+        // A bare CharClass/Literal leaf is a token, not a whitespace-
+        // separated sequence element, so its repetition must not skip
+        // internal whitespace -- "[0-9]+" should match "12" as one number,
+        // not swallow "1 2" as though the space were insignificant.
+        // Repeated rule references and parenthesized groups keep the
+        // normal whitespace-tolerant behavior, since those are usually
+        // themselves whitespace-separated sequence elements (e.g. "(a b)*").
+        atomic := strings.HasPrefix(p.description, "CharClass(") || strings.HasPrefix(p.description, "Literal(")
+        switch parts[1].(string) {
+        case "*":
+            rep := ZeroOrMoreOf(p)
+            if atomic {
+                rep.Adjacent()
+            }
+            return rep
+        case "+":
+            rep := OneOrMoreOf(p)
+            if atomic {
+                rep.Adjacent()
+            }
+            return rep
+        default:
+            return Optional(p)
+        }
+    }).Describe("repeated-term")
+
+    predicated := OneOf(
+        Sequence(Literal("&"), repeated).Handle(func(s *State) interface{} {
+            return And(s.result.([]interface{})[1].(*Parser))
+        }),
+        Sequence(Literal("!"), repeated).Handle(func(s *State) interface{} {
+            return Not(s.result.([]interface{})[1].(*Parser))
+        }),
+        repeated,
+    ).Describe("predicated-term")
+
+    // A rule's body is whitespace-separated like any other sequence, so
+    // without this guard it would run right on into the next rule: "term"
+    // in "expr <- term\nterm <- num" looks exactly like one more item of
+    // expr's own sequence.  Stop as soon as the next token looks like
+    // another rule's "Name <-" header.
+    ruleHeader := Sequence(identTok, Literal("<-"))
+    sequence := OneOrMoreOf(Sequence(Not(ruleHeader), predicated).Pick(2)).Handle(func(s *State) interface{} {
+        items := s.result.([]interface{})
+        if len(items) == 1 {
+            return items[0].(*Parser)
+        }
+        return Sequence(items...)
+    }).Describe("sequence")
+
+    choice := Sequence(sequence, ZeroOrMoreOf(Sequence(Literal("/"), sequence).Pick(2))).Handle(func(s *State) interface{} {
+        parts := s.result.([]interface{})
+        first := parts[0].(*Parser)
+        rest := parts[1].([]interface{})
+        if len(rest) == 0 {
+            return first
+        }
+        alts := append([]interface{}{first}, rest...)
+        return OneOf(alts...)
+    }).Describe("choice")
+
+    expr.Bind(choice)
+
+    ruleDef := Sequence(identTok, Literal("<-"), expr).Handle(func(s *State) interface{} {
+        parts := s.result.([]interface{})
+        return [2]interface{}{parts[0].(string), parts[2].(*Parser)}
+    }).Describe("rule")
+
+    grammarParser := OneOrMoreOf(ruleDef)
+
+    result, perr := grammarParser.Parse(grammar)
+    if perr != nil {
+        return nil, perr
+    }
+
+    rules = make(map[string]*Parser)
+    for _, def := range result.([]interface{}) {
+        pair := def.([2]interface{})
+        name := pair[0].(string)
+        body := pair[1].(*Parser)
+        rules[name] = makeRule(name, body)
+    }
+    for name, ref := range refs {
+        rule, ok := rules[name]
+        if !ok {
+            return nil, fmt.Errorf("peggy: grammar error: rule %q is referenced but never defined", name)
+        }
+        ref.Bind(rule)
+    }
+
+    return rules, nil
+}
+
+// SetAction attaches an action function to a rule compiled by Compile: once
+// the rule's body matches, action runs with that match's labeled captures
+// (see State.GetLabel) still in scope, and its return value becomes the
+// rule's own match result.
+//
+func SetAction(rules map[string]*Parser, name string, action func(s *State) interface{}) {
+    rule, ok := rules[name]
+    if !ok {
+        panic(fmt.Sprintf("peggy: SetAction: no such rule %q", name))
+    }
+    rule.subParsers[0].Handle(action)
+}
+
+// Wrap a compiled rule's body so that a label frame is pushed before it
+// runs (so any "label:expr" terms inside it have somewhere to record their
+// capture) and popped after -- including after SetAction's action, if any,
+// has run, since that's the one place a Handle callback needs GetLabel to
+// still see this rule's labels.  Built as two layers (inner pushes the frame
+// and holds the body + action, outer pops it) because the generic handler-invocation
+// step in invokeUncached runs between inner.parse returning and inner.invoke
+// returning, which is exactly the window the action needs the frame alive.
+//
+func makeRule(name string, body *Parser) *Parser {
+    inner := newParser(name, false, false, []*Parser{body}, func(state *State, input []rune) (bool, int, interface{}) {
+        state.pushLabelFrame()
+        return body.invoke(state, input)
+    })
+    outer := newParser(name, false, false, []*Parser{inner}, func(state *State, input []rune) (bool, int, interface{}) {
+        match, used, result := inner.invoke(state, input)
+        state.popLabelFrame()
+        return match, used, result
+    })
+    return outer
+}
+
+// Scan a double-quoted grammar string literal ("...", with \n \t \\ \"
+// escapes), returning its unescaped text.
+//
+func scanStringLiteral() *Parser {
+    return newParser("string-literal", false, true, nil, func(state *State, input []rune) (bool, int, interface{}) {
+        if input[0] != '"' {
+            return false, 0, nil
+        }
+        var out []rune
+        i := 1
+        for i < len(input) {
+            if input[i] == '"' {
+                return true, i + 1, string(out)
+            }
+            if input[i] == '\\' && i+1 < len(input) {
+                i += 1
+                switch input[i] {
+                case 'n':
+                    out = append(out, '\n')
+                case 't':
+                    out = append(out, '\t')
+                default:
+                    out = append(out, input[i])
+                }
+                i += 1
+                continue
+            }
+            out = append(out, input[i])
+            i += 1
+        }
+        return false, 0, nil
+    })
+}
+
+// Scan a bracketed CharClass spec (e.g. "[a-zA-Z_]", "[^\n]", "[\p{L}]")
+// out of grammar source, returning its raw text -- brackets included, since
+// that's exactly what CharClass(spec) expects.
+//
+func scanCharClassSpan() *Parser {
+    return newParser("charclass-literal", false, true, nil, func(state *State, input []rune) (bool, int, interface{}) {
+        if input[0] != '[' {
+            return false, 0, nil
+        }
+        i := 1
+        for i < len(input) {
+            if input[i] == '\\' && i+1 < len(input) {
+                i += 2
+                continue
+            }
+            if input[i] == ']' {
+                i += 1
+                return true, i, string(input[:i])
+            }
+            i += 1
+        }
+        return false, 0, nil
+    })
+}
+
@@ -0,0 +1,103 @@
+//go:build peggydebug
+// +build peggydebug
+
+package peggy
+
+import (
+    "io"
+    "log"
+    "strings"
+    "sync"
+)
+
+// EnableLogging directs invoke() trace output and the memo hit/miss summary
+// printed at the end of each Parse/ParseRaw/ParseReader to w; this is only
+// available in a binary built with "-tags peggydebug" (see peggy_nodebug.go
+// for the zero-cost default).
+//
+func EnableLogging(w io.Writer) {
+    log.SetOutput(w)
+}
+
+func indent(state *State) string {
+    return strings.Repeat(" ", state.depth*4)
+}
+
+func traceEnter(state *State, parser *Parser, input []rune) {
+    if state.debug > 0 {
+        log.Printf("%s-> %s on '%s'\n", indent(state), parser.description, string(input))
+    }
+    state.depth += 1
+    state.debug -= 1
+}
+
+func traceExit(state *State, parser *Parser, match bool, used int, result interface{}) {
+    state.depth -= 1
+    state.debug += 1
+    if state.debug > 0 {
+        log.Printf("%s<- %s %v, len=%d, result=%v", indent(state), parser.description, match, used, result)
+    }
+}
+
+func traceFlattenBefore(state *State, result interface{}) {
+    if state.debug > 0 {
+        log.Printf("%sflatten -> %#v\n", indent(state), result)
+    }
+}
+
+func traceFlattenAfter(state *State, result interface{}) {
+    if state.debug > 0 {
+        log.Printf("%sflatten <- %#v\n", indent(state), result)
+    }
+}
+
+func traceCantFlatten(state *State, result interface{}) {
+    if state.debug > 0 {
+        log.Printf("%scan't flatten %#v\n", indent(state), result)
+    }
+}
+
+func traceHandlerBefore(state *State, result interface{}) {
+    if state.debug > 0 {
+        log.Printf("%sHandler => %#v\n", indent(state), result)
+    }
+}
+
+func traceHandlerAfter(state *State, result interface{}) {
+    if state.debug > 0 {
+        log.Printf("%sHandler <= %#v\n", indent(state), result)
+    }
+}
+
+// Per-parser packrat cache hit/miss counts, kept only under this build tag
+// so production builds never pay for the bookkeeping.
+var counterLock sync.Mutex
+var hitCounts = map[*Parser]int{}
+var missCounts = map[*Parser]int{}
+
+func traceMemoHit(parser *Parser) {
+    counterLock.Lock()
+    hitCounts[parser] += 1
+    counterLock.Unlock()
+}
+
+func traceMemoMiss(parser *Parser) {
+    counterLock.Lock()
+    missCounts[parser] += 1
+    counterLock.Unlock()
+}
+
+// Print accumulated memo hit/miss counts for every memoized parser that's
+// been invoked so far, called at the end of each top-level Parse/ParseRaw/
+// ParseReader.  Counts accumulate across calls, same as a pprof counter, so
+// repeated parses in one process show their cumulative cache effectiveness.
+//
+func tracePrintCounters() {
+    counterLock.Lock()
+    defer counterLock.Unlock()
+    // every memoized parser's first invocation in a parse is a miss, so
+    // missCounts has an entry for each one, hits or not
+    for parser, misses := range missCounts {
+        log.Printf("memo %s: %d hits, %d misses", parser.description, hitCounts[parser], misses)
+    }
+}
@@ -0,0 +1,38 @@
+//go:build !peggydebug
+// +build !peggydebug
+
+package peggy
+
+import "io"
+
+// Trace hooks for invoke()/invokeUncached(); see peggy_debug.go for what
+// these do under "-tags peggydebug".  Here they're empty so the compiler
+// can inline them away, and state.depth/state.debug are never touched --
+// Parser.Debug(n) still compiles, it just has nothing to report to.
+
+func traceEnter(state *State, parser *Parser, input []rune) {}
+
+func traceExit(state *State, parser *Parser, match bool, used int, result interface{}) {}
+
+func traceFlattenBefore(state *State, result interface{}) {}
+
+func traceFlattenAfter(state *State, result interface{}) {}
+
+func traceCantFlatten(state *State, result interface{}) {}
+
+func traceHandlerBefore(state *State, result interface{}) {}
+
+func traceHandlerAfter(state *State, result interface{}) {}
+
+func traceMemoHit(parser *Parser) {}
+
+func traceMemoMiss(parser *Parser) {}
+
+func tracePrintCounters() {}
+
+// EnableLogging directs invoke() trace output and the per-parser memo
+// hit/miss summary to w; see peggy_debug.go.  Building without "-tags peggydebug" makes
+// this a no-op, so callers can call it unconditionally without needing a
+// build tag of their own.
+//
+func EnableLogging(w io.Writer) {}
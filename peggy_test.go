@@ -1,16 +1,19 @@
 package peggy
 
 import (
-    . "launchpad.net/gocheck"
+    gc "launchpad.net/gocheck"
     "log"
     "os"
+    "strconv"
+    "strings"
     "testing"
+    "time"
 )
 
 // Hook up gocheck into the "go test" runner. 
-func Test(t *testing.T) { TestingT(t) }
+func Test(t *testing.T) { gc.TestingT(t) }
 type MySuite struct{} 
-var _ = Suite(&MySuite{})
+var _ = gc.Suite(&MySuite{})
 
 type TypeVar struct {
     arrow *string
@@ -20,15 +23,16 @@ type TypeVar struct {
 
 // This fixture still in progress, has some test code for helmet.
 //
-func (s *MySuite) TestBasics(c *C) {
+func (s *MySuite) TestBasics(c *gc.C) {
 
     letter := AnyOf("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_")
     number := AnyOf("0123456789")
 
     identifier := Sequence(letter, ZeroOrMoreOf(OneOf(letter, number))).Adjacent().As(String)
 
-    _, _, result := identifier.Parse("foo")
-    c.Check("foo", Equals, result)
+    result, err := identifier.Parse("foo")
+    c.Assert(err, gc.IsNil)
+    c.Check("foo", gc.Equals, result)
 
     typeVar := Sequence(identifier, identifier).
         Handle(func(s *State) interface{} {
@@ -57,7 +61,7 @@ func (s *MySuite) TestBasics(c *C) {
 
 // Simple calculator.  User data values are simply floats.
 //
-func (s *MySuite) TestCalculator(c *C) {
+func (s *MySuite) TestCalculator(c *gc.C) {
 
     console, err := os.OpenFile("./test.log", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
     if err != nil {
@@ -111,9 +115,10 @@ func (s *MySuite) TestCalculator(c *C) {
     expr1.Bind(_xpr1).Debug(4)
 
     try := func(expr string, expected float64) {
-        _, _, result := expr1.Parse(expr)
+        result, err := expr1.Parse(expr)
+        c.Assert(err, gc.IsNil)
         actual := result.(float64)
-        c.Check(actual, Equals, expected)
+        c.Check(actual, gc.Equals, expected)
     }
 
     try(" 1 + 2  + 3", 6.0)
@@ -124,3 +129,264 @@ func (s *MySuite) TestCalculator(c *C) {
     try ("5 + (5 * 5) - ((5 + 5) / 5)", 28.0)
 }
 
+// Without memoization, "chain" below is exponential: at every offset, both
+// of its first two alternatives re-derive "chain" at the same following
+// offset before failing, and the only way out is the plain "a" fallback.
+// Memoize(true) on the rule's body collapses that into one computation per
+// offset, so even a 100k-token input should parse in a few seconds rather
+// than never finishing.
+//
+func (s *MySuite) TestMemoizeLinearTime(c *gc.C) {
+
+    chain := Deferred()
+    body := OneOf(
+        Sequence("a", chain, "!"),
+        Sequence("a", chain, "?"),
+        Literal("a"),
+    ).Memoize(true)
+    chain.Bind(body)
+
+    input := strings.Repeat("a", 100000)
+    start := time.Now()
+    match, used, _ := chain.ParseRaw(input)
+    elapsed := time.Since(start)
+
+    c.Check(match, gc.Equals, true)
+    c.Check(used, gc.Equals, 1)
+    c.Check(elapsed < 10*time.Second, gc.Equals, true)
+}
+
+// CharClass should accept regexp-style ranges, negation, and \p{...}
+// Unicode-category shorthands, matching a single rune against each.
+//
+func (s *MySuite) TestCharClass(c *gc.C) {
+
+    ident := OneOrMoreOf(CharClass("[a-zA-Z0-9_]")).Adjacent().As(String)
+    result, err := ident.Parse("foo_123")
+    c.Assert(err, gc.IsNil)
+    c.Check(result, gc.Equals, "foo_123")
+
+    notNewline := CharClass("[^\n]")
+    _, err2 := notNewline.Parse("x")
+    c.Assert(err2, gc.IsNil)
+    _, err3 := notNewline.Parse("\n")
+    c.Assert(err3, gc.NotNil)
+
+    letterOrDigit := OneOrMoreOf(CharClass(`[\p{L}\p{Nd}]`)).Adjacent().As(String)
+    result2, err4 := letterOrDigit.Parse("abc123")
+    c.Assert(err4, gc.IsNil)
+    c.Check(result2, gc.Equals, "abc123")
+
+    c.Check(func() { CharClass("[]") }, gc.Panics,
+        `peggy: CharClass: empty character class "[]"`)
+}
+
+// And/Not should disambiguate a keyword from an identifier that merely
+// starts with it, without consuming input or running the subparser's
+// handler.
+//
+func (s *MySuite) TestAndNot(c *gc.C) {
+
+    letter := AnyOf("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz_")
+    digit := AnyOf("0123456789")
+    idChar := OneOf(letter, digit)
+
+    ifKeyword := Sequence(Literal("if"), Not(idChar)).Adjacent().Pick(1)
+
+    result, err := ifKeyword.Parse("if (x)")
+    c.Assert(err, gc.IsNil)
+    c.Check(result, gc.Equals, "if")
+
+    _, err2 := ifKeyword.Parse("ify")
+    c.Assert(err2, gc.NotNil)
+
+    lookahead := Sequence(And(Literal("foo")), Literal("foo")).Pick(2)
+    result3, err3 := lookahead.Parse("foo")
+    c.Assert(err3, gc.IsNil)
+    c.Check(result3, gc.Equals, "foo")
+}
+
+// Parse failures should report the furthest position reached, and name the
+// reportable parsers (Literals, AnyOf, or anything given a Describe) that
+// were tried there.
+//
+func (s *MySuite) TestParseError(c *gc.C) {
+
+    digit := AnyOf("0123456789").Describe("digit")
+    number := OneOrMoreOf(digit).Adjacent()
+    sum := Sequence(number, Literal("+"), number).Describe("sum")
+
+    result, err := sum.Parse("12 + ")
+    c.Check(result, gc.IsNil)
+    c.Assert(err, gc.NotNil)
+    perr := err.(*ParseError)
+    c.Check(perr.Line, gc.Equals, 1)
+    c.Check(perr.Column, gc.Equals, 6)
+    c.Check(perr.Error(), gc.Equals, `parse error at 1:6: expected digit, got "<EOF>"`)
+}
+
+// State.Pos() should report where the current handler's match began, for
+// handlers that want to annotate ASTs with source locations.
+//
+func (s *MySuite) TestStatePos(c *gc.C) {
+
+    var line, col int
+    word := OneOrMoreOf(AnyOf("abcdefghijklmnopqrstuvwxyz")).Adjacent().
+        Handle(func(s *State) interface{} {
+            line, col = s.Pos()
+            return s.Text()
+        })
+
+    _, err := word.Parse("  cat")
+    c.Assert(err, gc.IsNil)
+    c.Check(line, gc.Equals, 1)
+    c.Check(col, gc.Equals, 3)
+}
+
+// Compile should build a working rule map from a pigeon-style "Name <- expr"
+// grammar, wiring up recursive/forward rule references via Deferred/Bind,
+// and SetAction should let a rule's action see its labeled captures.
+//
+func (s *MySuite) TestCompile(c *gc.C) {
+
+    rules, err := Compile(`
+        expr <- term (("+" / "-") term)*
+        term <- num
+        num <- [0-9]+
+    `)
+    c.Assert(err, gc.IsNil)
+
+    toInt := func(s *State) interface{} {
+        v, _ := strconv.Atoi(s.Text())
+        return v
+    }
+    SetAction(rules, "num", toInt)
+    SetAction(rules, "expr", func(s *State) interface{} {
+        parts := s.result.([]interface{})
+        total := parts[0].(int)
+        for _, r := range parts[1].([]interface{}) {
+            pair := r.([]interface{})
+            if pair[0].(string) == "+" {
+                total += pair[1].(int)
+            } else {
+                total -= pair[1].(int)
+            }
+        }
+        return total
+    })
+
+    result, perr := rules["expr"].Parse("1 + 2 - 3")
+    c.Assert(perr, gc.IsNil)
+    c.Check(result, gc.Equals, 0)
+
+    _, err2 := Compile(`a <- b`)
+    c.Assert(err2, gc.NotNil)
+}
+
+// Repeating a bare CharClass/Literal leaf ("[0-9]+") must not skip internal
+// whitespace -- it's a token, not a whitespace-separated sequence element --
+// while repeating a parenthesized group still tolerates the normal
+// whitespace between its elements.
+//
+func (s *MySuite) TestCompileCharClassRepetitionIsAdjacent(c *gc.C) {
+
+    rules, err := Compile(`num <- [0-9]+`)
+    c.Assert(err, gc.IsNil)
+
+    match, used, _ := rules["num"].ParseRaw("1 2")
+    c.Check(match, gc.Equals, true)
+    c.Check(used, gc.Equals, 1)
+}
+
+// A label:expr capture inside a Compile()-d rule should be visible to that
+// rule's action via State.GetLabel, even once nested inside further rules.
+//
+func (s *MySuite) TestCompileLabels(c *gc.C) {
+
+    rules, err := Compile(`
+        pair <- a:num "," b:num
+        num <- [0-9]+
+    `)
+    c.Assert(err, gc.IsNil)
+
+    SetAction(rules, "num", func(s *State) interface{} {
+        v, _ := strconv.Atoi(s.Text())
+        return v
+    })
+    SetAction(rules, "pair", func(s *State) interface{} {
+        return s.GetLabel("a").(int) + s.GetLabel("b").(int)
+    })
+
+    result, perr := rules["pair"].Parse("12,34")
+    c.Assert(perr, gc.IsNil)
+    c.Check(result, gc.Equals, 46)
+}
+
+// ParseReader should behave exactly like Parse, but pulling its runes from
+// an io.RuneReader instead of a string.
+//
+func (s *MySuite) TestParseReader(c *gc.C) {
+
+    ident := OneOrMoreOf(CharClass("[a-zA-Z]")).Adjacent().As(String)
+
+    match, used, result, err := ident.ParseReader(strings.NewReader("hello world"))
+    c.Assert(err, gc.IsNil)
+    c.Check(match, gc.Equals, true)
+    c.Check(used, gc.Equals, 5)
+    c.Check(result, gc.Equals, "hello")
+
+    _, _, _, err2 := ident.ParseReader(strings.NewReader("123"))
+    c.Assert(err2, gc.NotNil)
+}
+
+// MaxBacktrack should bound how far ParseReader grows its lookahead buffer:
+// a match that succeeds on input shorter than the bound still works, but a
+// grammar that needs to see past the bound before it can match at all fails
+// with an error instead of buffering the rest of the stream.
+//
+func (s *MySuite) TestParseReaderMaxBacktrack(c *gc.C) {
+
+    ident := OneOrMoreOf(CharClass("[a-zA-Z]")).Adjacent().As(String).MaxBacktrack(4)
+
+    match, used, result, err := ident.ParseReader(strings.NewReader("ab cd"))
+    c.Assert(err, gc.IsNil)
+    c.Check(match, gc.Equals, true)
+    c.Check(used, gc.Equals, 2)
+    c.Check(result, gc.Equals, "ab")
+
+    terminated := Sequence(OneOrMoreOf(CharClass("[a-z]")).Adjacent(), Literal(";")).MaxBacktrack(4)
+    match2, _, _, err2 := terminated.ParseReader(strings.NewReader("abcdefgh;"))
+    c.Check(match2, gc.Equals, false)
+    c.Assert(err2, gc.NotNil)
+}
+
+// Benchmark invoke() on a JSON-shaped grammar (nested arrays of numbers),
+// comparing the default build against "-tags peggydebug":
+//
+//     go test -bench BenchmarkParseArray -run NONE
+//     go test -bench BenchmarkParseArray -run NONE -tags peggydebug
+//
+func BenchmarkParseArray(b *testing.B) {
+    rules, err := Compile(`
+        array <- "[" (value ("," value)*)? "]"
+        value <- array / num
+        num <- [0-9]+
+    `)
+    if err != nil {
+        b.Fatalf("unexpected error: %v", err)
+    }
+    SetAction(rules, "num", func(s *State) interface{} { return nil })
+    SetAction(rules, "value", func(s *State) interface{} { return nil })
+    SetAction(rules, "array", func(s *State) interface{} { return nil })
+
+    input := "[1,2,[3,4,5],[6,[7,8],9],10]"
+    array := rules["array"]
+
+    b.ResetTimer()
+    for i := 0; i < b.N; i++ {
+        if _, err := array.Parse(input); err != nil {
+            b.Fatalf("unexpected error: %v", err)
+        }
+    }
+}
+